@@ -1,15 +1,9 @@
 package backups
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"io/ioutil"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"time"
 )
 
 // Backend provides read and write capabilities to a filesystem-like storage.
@@ -18,102 +12,137 @@ type Backend interface {
 	Read(name string) (io.Reader, error)
 }
 
-// NoSuchName is an error returned by `Backend` when a name does not exist.
-type NoSuchName struct {
-	Name string
+// Checker is implemented by backends that can check whether a name exists
+// without reading its contents.
+type Checker interface {
+	Exists(name string) (bool, error)
 }
 
-func (e NoSuchName) Error() string {
-	return fmt.Sprintf("%s does not exist", e.Name)
+// RangeReader is implemented by backends that can read part of a name, which
+// allows large versions to be downloaded in concurrent ranges.
+type RangeReader interface {
+	Size(name string) (int64, error)
+	ReadRange(name string, offset int64, length int64) (io.Reader, error)
 }
 
-// S3Backend provides a Backend to AWS S3. This will also work with Digital
-// Ocean Spaces, since this product is also S3-compatible.
-type S3Backend struct {
-	session *session.Session
+// MultipartStorer is implemented by backends that can store a name as a series
+// of parts uploaded independently of each other, which allows large versions
+// to be uploaded in concurrent parts.
+type MultipartStorer interface {
+	// CreateMultipart starts a multipart upload of `name`, returning an ID
+	// that identifies the upload in the other methods.
+	CreateMultipart(name string) (string, error)
+
+	// StorePart stores part `number` of the upload, numbered from 1, and
+	// returns a tag identifying the stored part. It returns NoSuchName with
+	// the upload ID if the upload does not exist.
+	StorePart(name string, uploadID string, number int, reader io.ReadSeeker) (string, error)
+
+	// CompleteMultipart stores `name` as the concatenation of `parts`.
+	CompleteMultipart(name string, uploadID string, parts []Part) error
 
-	// The bucket in which to manage backups.
-	bucket string
+	// AbortMultipart discards the upload and any parts stored for it.
+	AbortMultipart(name string, uploadID string) error
 }
 
-// NewS3Backend returns an S3Backend with the given session and bucket.
-func NewS3Backend(session *session.Session, bucket string) S3Backend {
-	return S3Backend{
-		session: session,
-		bucket:  bucket,
-	}
+// Deleter is implemented by backends that can delete a name. Deleting a name
+// that does not exist is not an error.
+type Deleter interface {
+	Delete(name string) error
 }
 
-// Store stores `reader`'s bytes under `name` in S3 under the configured bucket.
-func (b S3Backend) Store(name string, reader io.Reader) error {
-	svc := s3.New(b.session)
+// ConditionalStorer is implemented by backends that can store a name only if
+// it has not changed since it was read, which prevents concurrent writers
+// from overwriting each other's changes.
+type ConditionalStorer interface {
+	// ReadTagged is like Read, but also returns a tag identifying the
+	// stored contents, which changes every time the name is stored.
+	ReadTagged(name string) (io.Reader, string, error)
+
+	// StoreIf stores `name` only if its tag is still `tag`, or only if it
+	// does not exist if `tag` is empty. It returns Conflict if not.
+	StoreIf(name string, reader io.Reader, tag string) error
+}
 
-	contents, err := ioutil.ReadAll(reader)
-	if err != nil {
-		return err
-	}
+// Conflict is an error returned by `ConditionalStorer` when a name was changed
+// by another writer.
+type Conflict struct {
+	Name string
+}
 
-	input := &s3.PutObjectInput{
-		Body:   bytes.NewReader(contents),
-		Bucket: aws.String(b.bucket),
-		Key:    aws.String(name),
-	}
+func (e Conflict) Error() string {
+	return fmt.Sprintf("%s was changed by another writer", e.Name)
+}
 
-	_, err = svc.PutObject(input)
+// Lister is implemented by backends that can list the names they store.
+type Lister interface {
+	// List returns every stored object whose name begins with `prefix`.
+	List(prefix string) ([]Object, error)
+}
 
-	return err
+// Object describes a single name stored in a backend.
+type Object struct {
+	Name         string
+	Size         int64
+	LastModified time.Time
 }
 
-// Read attempts to download `name` from S3 and return a reader.
-func (b S3Backend) Read(name string) (io.Reader, error) {
-	svc := s3.New(b.session)
+// Part is a single part of a multipart upload.
+type Part struct {
+	Number int    `json:"number"`
+	Tag    string `json:"tag"`
+	Size   int64  `json:"size"`
 
-	input := &s3.GetObjectInput{
-		Bucket: aws.String(b.bucket),
-		Key:    aws.String(name),
+	// Checksum is the hex encoded SHA-256 sum of the part's contents, used
+	// to check that a resumed upload's parts are still the same.
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// NoSuchName is an error returned by `Backend` when a name does not exist.
+type NoSuchName struct {
+	Name string
+}
+
+func (e NoSuchName) Error() string {
+	return fmt.Sprintf("%s does not exist", e.Name)
+}
+
+// exists checks whether `name` exists in `backend`, falling back to reading it
+// if the backend cannot check for existence directly.
+func exists(backend Backend, name string) (bool, error) {
+	if checker, ok := backend.(Checker); ok {
+		return checker.Exists(name)
 	}
 
-	output, err := svc.GetObject(input)
-	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case s3.ErrCodeNoSuchKey:
-				return nil, NoSuchName{name}
-			default:
-				return nil, err
-			}
-		} else {
-			return nil, err
+	if _, err := backend.Read(name); err != nil {
+		if _, ok := err.(NoSuchName); ok {
+			return false, nil
 		}
+		return false, err
 	}
 
-	return output.Body, nil
+	return true, nil
 }
 
-// InMemoryBackend stores backups in a slice. This should only be used for testing.
-type InMemoryBackend struct {
-	Backups map[string][]byte
-}
-
-func NewInMemoryBackend() *InMemoryBackend {
-	return &InMemoryBackend{
-		Backups: make(map[string][]byte),
+// readTagged reads `name` and its tag from `backend`, which is empty if the
+// backend does not implement ConditionalStorer.
+func readTagged(backend Backend, name string) (io.Reader, string, error) {
+	if storer, ok := backend.(ConditionalStorer); ok {
+		return storer.ReadTagged(name)
 	}
-}
 
-func (b *InMemoryBackend) Store(name string, reader io.Reader) error {
-	contents, _ := ioutil.ReadAll(reader)
-	b.Backups[name] = contents
+	reader, err := backend.Read(name)
 
-	return nil
+	return reader, "", err
 }
 
-func (b *InMemoryBackend) Read(name string) (io.Reader, error) {
-	if value, ok := b.Backups[name]; ok {
-		reader := bytes.NewReader(value)
-
-		return reader, nil
+// storeIf stores `name` in `backend` only if its tag is still `tag`, see
+// ConditionalStorer, or unconditionally if the backend does not implement
+// ConditionalStorer.
+func storeIf(backend Backend, name string, reader io.Reader, tag string) error {
+	if storer, ok := backend.(ConditionalStorer); ok {
+		return storer.StoreIf(name, reader, tag)
 	}
 
-	return nil, NoSuchName{name}
+	return backend.Store(name, reader)
 }
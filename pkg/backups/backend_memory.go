@@ -0,0 +1,266 @@
+package backups
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InMemoryBackend stores backups in a slice. This should only be used for testing.
+type InMemoryBackend struct {
+	Backups map[string][]byte
+
+	// Modified holds the time each name was last stored.
+	Modified map[string]time.Time
+
+	// tags holds the tag of each name, which is the generation it was last
+	// stored in.
+	tags       map[string]string
+	generation int
+
+	// uploads holds the stored parts of each unfinished multipart upload.
+	uploads map[string]map[int][]byte
+	nextID  int
+	mu      sync.Mutex
+}
+
+func NewInMemoryBackend() *InMemoryBackend {
+	return &InMemoryBackend{
+		Backups:  make(map[string][]byte),
+		Modified: make(map[string]time.Time),
+		uploads:  make(map[string]map[int][]byte),
+	}
+}
+
+func (b *InMemoryBackend) Store(name string, reader io.Reader) error {
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.Backups[name] = contents
+	b.touch(name)
+
+	return nil
+}
+
+func (b *InMemoryBackend) Read(name string) (io.Reader, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if value, ok := b.Backups[name]; ok {
+		reader := bytes.NewReader(value)
+
+		return reader, nil
+	}
+
+	return nil, NoSuchName{name}
+}
+
+func (b *InMemoryBackend) ReadTagged(name string) (io.Reader, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if value, ok := b.Backups[name]; ok {
+		return bytes.NewReader(value), b.tag(name), nil
+	}
+
+	return nil, "", NoSuchName{name}
+}
+
+func (b *InMemoryBackend) StoreIf(name string, reader io.Reader, tag string) error {
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.tag(name) != tag {
+		return Conflict{name}
+	}
+
+	b.Backups[name] = contents
+	b.touch(name)
+
+	return nil
+}
+
+func (b *InMemoryBackend) Exists(name string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.Backups[name]
+
+	return ok, nil
+}
+
+func (b *InMemoryBackend) Delete(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.Backups, name)
+	delete(b.Modified, name)
+	delete(b.tags, name)
+
+	return nil
+}
+
+func (b *InMemoryBackend) List(prefix string) ([]Object, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var objects []Object
+	for name, value := range b.Backups {
+		if strings.HasPrefix(name, prefix) {
+			objects = append(objects, Object{
+				Name:         name,
+				Size:         int64(len(value)),
+				LastModified: b.Modified[name],
+			})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Name < objects[j].Name })
+
+	return objects, nil
+}
+
+func (b *InMemoryBackend) Size(name string) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if value, ok := b.Backups[name]; ok {
+		return int64(len(value)), nil
+	}
+
+	return 0, NoSuchName{name}
+}
+
+func (b *InMemoryBackend) ReadRange(name string, offset int64, length int64) (io.Reader, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	value, ok := b.Backups[name]
+	if !ok {
+		return nil, NoSuchName{name}
+	}
+
+	if offset > int64(len(value)) {
+		offset = int64(len(value))
+	}
+	if offset+length > int64(len(value)) {
+		length = int64(len(value)) - offset
+	}
+
+	return bytes.NewReader(value[offset : offset+length]), nil
+}
+
+func (b *InMemoryBackend) CreateMultipart(name string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.uploads == nil {
+		b.uploads = make(map[string]map[int][]byte)
+	}
+
+	b.nextID++
+	uploadID := fmt.Sprintf("%s#%d", name, b.nextID)
+	b.uploads[uploadID] = make(map[int][]byte)
+
+	return uploadID, nil
+}
+
+func (b *InMemoryBackend) StorePart(name string, uploadID string, number int, reader io.ReadSeeker) (string, error) {
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	parts, ok := b.uploads[uploadID]
+	if !ok {
+		return "", NoSuchName{uploadID}
+	}
+	parts[number] = contents
+
+	return fmt.Sprintf("%s#%d", uploadID, number), nil
+}
+
+func (b *InMemoryBackend) CompleteMultipart(name string, uploadID string, parts []Part) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stored, ok := b.uploads[uploadID]
+	if !ok {
+		return NoSuchName{uploadID}
+	}
+
+	parts = append([]Part{}, parts...)
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+
+	var contents []byte
+	for _, part := range parts {
+		value, ok := stored[part.Number]
+		if !ok || part.Tag != fmt.Sprintf("%s#%d", uploadID, part.Number) {
+			return fmt.Errorf("part %d of %s was not uploaded", part.Number, uploadID)
+		}
+		contents = append(contents, value...)
+	}
+
+	b.Backups[name] = contents
+	b.touch(name)
+	delete(b.uploads, uploadID)
+
+	return nil
+}
+
+func (b *InMemoryBackend) AbortMultipart(name string, uploadID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.uploads, uploadID)
+
+	return nil
+}
+
+// touch records that `name` was just stored, giving it a new tag.
+func (b *InMemoryBackend) touch(name string) {
+	if b.Modified == nil {
+		b.Modified = make(map[string]time.Time)
+	}
+	b.Modified[name] = time.Now()
+	b.retag(name)
+}
+
+func (b *InMemoryBackend) retag(name string) {
+	if b.tags == nil {
+		b.tags = make(map[string]string)
+	}
+	b.generation++
+	b.tags[name] = strconv.Itoa(b.generation)
+}
+
+// tag returns the tag of `name`, giving names stored directly in Backups a
+// tag the first time it is needed.
+func (b *InMemoryBackend) tag(name string) string {
+	if _, ok := b.Backups[name]; !ok {
+		return ""
+	}
+
+	if b.tags[name] == "" {
+		b.retag(name)
+	}
+
+	return b.tags[name]
+}
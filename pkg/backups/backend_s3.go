@@ -0,0 +1,426 @@
+package backups
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// S3Backend provides a Backend to AWS S3. This will also work with Digital
+// Ocean Spaces, since this product is also S3-compatible.
+type S3Backend struct {
+	session *session.Session
+
+	// The bucket in which to manage backups.
+	bucket string
+
+	// conditional holds whether the provider supports conditional writes,
+	// once StoreIf has probed it. It is shared by copies of the backend.
+	conditional *conditionalWrites
+
+	// unconditional is set by WithoutConditionalWrites.
+	unconditional bool
+}
+
+// NewS3Backend returns an S3Backend with the given session and bucket.
+func NewS3Backend(session *session.Session, bucket string) S3Backend {
+	return S3Backend{
+		session:     session,
+		bucket:      bucket,
+		conditional: &conditionalWrites{},
+	}
+}
+
+// WithoutConditionalWrites returns a copy of the backend whose StoreIf stores
+// unconditionally, for providers that don't support conditional writes.
+// Concurrent changes to the same lock or lease may then overwrite each other,
+// so backups of the same name must never run at the same time.
+func (b S3Backend) WithoutConditionalWrites() S3Backend {
+	b.unconditional = true
+
+	return b
+}
+
+// conditionalProbeKey is the name StoreIf stores to find out whether the
+// provider supports conditional writes.
+const conditionalProbeKey = KeyNamespace + "/conditional-writes"
+
+// conditionalWrites records the result of probing a provider for conditional
+// writes.
+type conditionalWrites struct {
+	mu        sync.Mutex
+	probed    bool
+	supported bool
+}
+
+// ConditionalWritesUnsupported is an error returned by S3Backend.StoreIf when
+// the provider ignores or rejects conditional writes, since ignoring them
+// would silently break the guarantees StoreIf exists for. See
+// S3Backend.WithoutConditionalWrites.
+type ConditionalWritesUnsupported struct {
+	Bucket string
+}
+
+func (e ConditionalWritesUnsupported) Error() string {
+	return fmt.Sprintf("the bucket %s does not support conditional writes, so concurrent backups could overwrite each other's changes", e.Bucket)
+}
+
+// Store stores `reader`'s bytes under `name` in S3 under the configured bucket.
+// The bytes are streamed to S3 in parts as they are read, so `reader` never
+// has to be held in memory or on disk in full.
+func (b S3Backend) Store(name string, reader io.Reader) error {
+	uploader := s3manager.NewUploader(b.session)
+
+	input := &s3manager.UploadInput{
+		Body:   reader,
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	_, err := uploader.Upload(input)
+
+	return err
+}
+
+// Exists checks whether `name` exists in the configured bucket.
+func (b S3Backend) Exists(name string) (bool, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	if _, err := svc.HeadObject(input); err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Read attempts to download `name` from S3 and return a reader.
+func (b S3Backend) Read(name string) (io.Reader, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	output, err := svc.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok {
+			switch aerr.Code() {
+			case s3.ErrCodeNoSuchKey:
+				return nil, NoSuchName{name}
+			default:
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return output.Body, nil
+}
+
+// Delete deletes `name` from S3.
+func (b S3Backend) Delete(name string) error {
+	svc := s3.New(b.session)
+
+	input := &s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	_, err := svc.DeleteObject(input)
+
+	return err
+}
+
+// List returns every object in the configured bucket whose name begins with
+// `prefix`.
+func (b S3Backend) List(prefix string) ([]Object, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	var objects []Object
+	err := svc.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, Object{
+				Name:         aws.StringValue(object.Key),
+				Size:         aws.Int64Value(object.Size),
+				LastModified: aws.TimeValue(object.LastModified),
+			})
+		}
+		return true
+	})
+
+	return objects, err
+}
+
+// ReadTagged is like Read, but also returns the ETag of `name`.
+func (b S3Backend) ReadTagged(name string) (io.Reader, string, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	output, err := svc.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, "", NoSuchName{name}
+		}
+		return nil, "", err
+	}
+
+	return output.Body, aws.StringValue(output.ETag), nil
+}
+
+// StoreIf stores `name` only if its ETag is still `tag`, using an If-Match
+// conditional write, or only if it does not exist if `tag` is empty, using
+// If-None-Match.
+//
+// Some S3-compatible providers ignore conditional writes and store
+// unconditionally, or reject them, so the first call probes the provider
+// with conditional writes that must fail. If they succeed or are rejected,
+// StoreIf returns ConditionalWritesUnsupported rather than storing, unless
+// the backend was created by WithoutConditionalWrites.
+func (b S3Backend) StoreIf(name string, reader io.Reader, tag string) error {
+	if b.unconditional {
+		return b.Store(name, reader)
+	}
+
+	if err := b.probeConditionalWrites(); err != nil {
+		return err
+	}
+
+	// Conditional writes are only supported by single part uploads, which
+	// need a seekable body.
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	return b.putIf(name, contents, tag)
+}
+
+// probeConditionalWrites returns ConditionalWritesUnsupported if the provider
+// stores conditional writes whose condition does not hold. The result is
+// remembered once the provider has answered.
+func (b S3Backend) probeConditionalWrites() error {
+	b.conditional.mu.Lock()
+	defer b.conditional.mu.Unlock()
+
+	if !b.conditional.probed {
+		probe := []byte("Probes whether conditional writes are supported")
+		if err := b.Store(conditionalProbeKey, bytes.NewReader(probe)); err != nil {
+			return err
+		}
+
+		// The probe exists and its ETag is never empty, so both writes
+		// must fail.
+		b.conditional.supported = true
+		for _, tag := range []string{"", `"systools-probe"`} {
+			err := b.putIf(conditionalProbeKey, probe, tag)
+			if err == nil || rejectsConditions(err) {
+				b.conditional.supported = false
+				break
+			}
+			if _, ok := err.(Conflict); !ok {
+				return err
+			}
+		}
+		b.conditional.probed = true
+	}
+
+	if !b.conditional.supported {
+		return ConditionalWritesUnsupported{b.bucket}
+	}
+
+	return nil
+}
+
+// rejectsConditions returns whether `err` is the response of a provider that
+// doesn't implement the conditional headers of a write.
+func rejectsConditions(err error) bool {
+	if aerr, ok := err.(awserr.RequestFailure); ok {
+		switch aerr.StatusCode() {
+		case http.StatusBadRequest, http.StatusNotImplemented:
+			return true
+		}
+	}
+
+	return false
+}
+
+// putIf stores `contents` under `name` with a single put, conditional on
+// `tag` as described by StoreIf.
+func (b S3Backend) putIf(name string, contents []byte, tag string) error {
+	svc := s3.New(b.session)
+
+	input := &s3.PutObjectInput{
+		Body:   bytes.NewReader(contents),
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	// This version of the SDK has no fields for conditional writes, so the
+	// headers are set on the request directly.
+	request, _ := svc.PutObjectRequest(input)
+	if tag == "" {
+		request.HTTPRequest.Header.Set("If-None-Match", "*")
+	} else {
+		request.HTTPRequest.Header.Set("If-Match", tag)
+	}
+
+	if err := request.Send(); err != nil {
+		if aerr, ok := err.(awserr.RequestFailure); ok {
+			switch aerr.StatusCode() {
+			case http.StatusPreconditionFailed, http.StatusConflict:
+				return Conflict{name}
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Size returns the size in bytes of `name`.
+func (b S3Backend) Size(name string) (int64, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	output, err := svc.HeadObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return 0, NoSuchName{name}
+		}
+		return 0, err
+	}
+
+	return aws.Int64Value(output.ContentLength), nil
+}
+
+// ReadRange downloads `length` bytes of `name` starting at `offset`.
+func (b S3Backend) ReadRange(name string, offset int64, length int64) (io.Reader, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	}
+
+	output, err := svc.GetObject(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, NoSuchName{name}
+		}
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+// CreateMultipart starts a multipart upload of `name`.
+func (b S3Backend) CreateMultipart(name string) (string, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(name),
+	}
+
+	output, err := svc.CreateMultipartUpload(input)
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(output.UploadId), nil
+}
+
+// StorePart uploads part `number` of a multipart upload and returns its ETag.
+func (b S3Backend) StorePart(name string, uploadID string, number int, reader io.ReadSeeker) (string, error) {
+	svc := s3.New(b.session)
+
+	input := &s3.UploadPartInput{
+		Body:       reader,
+		Bucket:     aws.String(b.bucket),
+		Key:        aws.String(name),
+		PartNumber: aws.Int64(int64(number)),
+		UploadId:   aws.String(uploadID),
+	}
+
+	output, err := svc.UploadPart(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			return "", NoSuchName{uploadID}
+		}
+		return "", err
+	}
+
+	return aws.StringValue(output.ETag), nil
+}
+
+// CompleteMultipart completes a multipart upload from its uploaded parts.
+func (b S3Backend) CompleteMultipart(name string, uploadID string, parts []Part) error {
+	svc := s3.New(b.session)
+
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = &s3.CompletedPart{
+			ETag:       aws.String(part.Tag),
+			PartNumber: aws.Int64(int64(part.Number)),
+		}
+	}
+
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(b.bucket),
+		Key:             aws.String(name),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+		UploadId:        aws.String(uploadID),
+	}
+
+	_, err := svc.CompleteMultipartUpload(input)
+
+	return err
+}
+
+// AbortMultipart aborts a multipart upload, deleting its uploaded parts.
+func (b S3Backend) AbortMultipart(name string, uploadID string) error {
+	svc := s3.New(b.session)
+
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(b.bucket),
+		Key:      aws.String(name),
+		UploadId: aws.String(uploadID),
+	}
+
+	_, err := svc.AbortMultipartUpload(input)
+
+	return err
+}
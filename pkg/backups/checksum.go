@@ -0,0 +1,71 @@
+package backups
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ChecksumMismatch is an error returned when a restored version's contents do
+// not match the checksum recorded when it was backed up.
+type ChecksumMismatch struct {
+	Name string
+}
+
+func (e ChecksumMismatch) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s", e.Name)
+}
+
+// summingReader computes the size and SHA-256 sum of everything read from it.
+type summingReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	size   int64
+}
+
+func newSummingReader(reader io.Reader) *summingReader {
+	return &summingReader{
+		reader: reader,
+		hash:   sha256.New(),
+	}
+}
+
+func (r *summingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.hash.Write(p[:n])
+	r.size += int64(n)
+
+	return n, err
+}
+
+// Checksum returns the hex encoded sum of the bytes read so far.
+func (r *summingReader) Checksum() string {
+	return hex.EncodeToString(r.hash.Sum(nil))
+}
+
+// verifyingReader returns an error in place of io.EOF if the bytes read from
+// it do not match the expected checksum.
+type verifyingReader struct {
+	*summingReader
+	name     string
+	checksum string
+}
+
+func newVerifyingReader(reader io.Reader, name string, checksum string) io.Reader {
+	return &verifyingReader{
+		summingReader: newSummingReader(reader),
+		name:          name,
+		checksum:      checksum,
+	}
+}
+
+func (r *verifyingReader) Read(p []byte) (int, error) {
+	n, err := r.summingReader.Read(p)
+	if err == io.EOF && r.Checksum() != r.checksum {
+		return n, ChecksumMismatch{r.name}
+	}
+
+	return n, err
+}
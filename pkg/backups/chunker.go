@@ -0,0 +1,116 @@
+package backups
+
+import (
+	"io"
+)
+
+const (
+	// minChunkSize is the smallest chunk a chunker will emit, except for the
+	// final chunk of a stream.
+	minChunkSize = 512 * 1024
+
+	// maxChunkSize is the largest chunk a chunker will emit.
+	maxChunkSize = 8 * 1024 * 1024
+
+	// chunkMask determines the average chunk size. A boundary is found when
+	// the rolling hash has all of these bits unset, which with 20 bits
+	// happens every 1 MiB on average beyond the minimum chunk size. The
+	// high bits are used since they depend on the most recent 64 bytes.
+	chunkMask = ((1 << 20) - 1) << 44
+)
+
+// gearTable maps each byte to a pseudo-random value mixed into the rolling
+// hash. It must never change, or chunk boundaries of new backups will no
+// longer line up with the chunks of existing ones.
+var gearTable [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed, so the table is the same everywhere.
+	seed := uint64(0x73797374_6f6f6c73)
+	for i := range gearTable {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gearTable[i] = z ^ (z >> 31)
+	}
+}
+
+// chunker splits a stream into content-defined chunks using a gear rolling
+// hash. Because boundaries depend only on the bytes around them, inserting or
+// removing data only changes the chunks near the edit, so unchanged regions
+// of a stream produce identical chunks across backups.
+type chunker struct {
+	reader io.Reader
+	buf    []byte
+
+	// start and end delimit the unconsumed bytes in buf.
+	start int
+	end   int
+	eof   bool
+}
+
+func newChunker(reader io.Reader) *chunker {
+	return &chunker{
+		reader: reader,
+		buf:    make([]byte, 2*maxChunkSize),
+	}
+}
+
+// Next returns the next chunk of the stream, or io.EOF once the stream has
+// been consumed. The returned slice is only valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	length := len(data)
+	if length > maxChunkSize {
+		length = maxChunkSize
+	}
+
+	if length > minChunkSize {
+		var hash uint64
+		for i := minChunkSize; i < length; i++ {
+			hash = (hash << 1) + gearTable[data[i]]
+			if hash&chunkMask == 0 {
+				length = i + 1
+				break
+			}
+		}
+	}
+
+	chunk := data[:length]
+	c.start += length
+
+	return chunk, nil
+}
+
+// fill reads from the underlying reader until at least maxChunkSize bytes are
+// buffered or the reader is exhausted.
+func (c *chunker) fill() error {
+	if c.end-c.start >= maxChunkSize || c.eof {
+		return nil
+	}
+
+	// Move the unconsumed bytes to the front of the buffer to make room.
+	c.end = copy(c.buf, c.buf[c.start:c.end])
+	c.start = 0
+
+	for c.end < maxChunkSize && !c.eof {
+		n, err := c.reader.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
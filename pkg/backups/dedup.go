@@ -0,0 +1,154 @@
+package backups
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// LayoutChunked is the layout of versions stored as deduplicated chunks. The
+// version's ID holds a ChunkIndex rather than the contents themselves.
+const LayoutChunked = "chunked"
+
+// ChunkIndex lists the chunks which, concatenated in order, make up the
+// contents of a chunked version.
+type ChunkIndex struct {
+	// Format is the format the index was written in, see ChunkIndexFormat.
+	Format int `json:"format,omitempty"`
+
+	Chunks []Chunk `json:"chunks"`
+}
+
+// Chunk is a single content-defined chunk of a version's contents.
+type Chunk struct {
+	// Hash is the hex encoded SHA-256 sum of the chunk's contents.
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// ID returns the name the chunk is stored under. Since chunks are addressed by
+// their contents, identical chunks of any version of any backup share an ID.
+func (c Chunk) ID() string {
+	return fmt.Sprintf("chunks/%s", c.Hash)
+}
+
+// storeChunked splits the contents of `reader` into chunks, stores each chunk
+// that does not yet exist in the backend and then stores the chunk index
+// under `id`.
+func (m Manager) storeChunked(id string, reader io.Reader) error {
+	index := ChunkIndex{Format: ChunkIndexFormat}
+	chunker := newChunker(reader)
+
+	for {
+		data, err := chunker.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(data)
+		chunk := Chunk{
+			Hash: hex.EncodeToString(sum[:]),
+			Size: int64(len(data)),
+		}
+		index.Chunks = append(index.Chunks, chunk)
+
+		found, err := exists(m.backend, chunk.ID())
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+
+		if err = m.backend.Store(chunk.ID(), bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+
+	indexBytes, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	return m.backend.Store(id, bytes.NewReader(indexBytes))
+}
+
+// readChunked reads the chunk index stored under `id` and returns a reader
+// that reassembles the version's contents from its chunks.
+func (m Manager) readChunked(id string) (io.Reader, error) {
+	index, err := m.readChunkIndex(id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &chunkReader{backend: m.backend, chunks: index.Chunks}, nil
+}
+
+// readChunkIndex reads the chunk index stored under `id`.
+func (m Manager) readChunkIndex(id string) (ChunkIndex, error) {
+	var index ChunkIndex
+
+	reader, err := m.backend.Read(id)
+	if err != nil {
+		return index, err
+	}
+
+	indexBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return index, err
+	}
+
+	if err = json.Unmarshal(indexBytes, &index); err != nil {
+		return index, fmt.Errorf("Invalid chunk index %s: %v", id, err)
+	}
+
+	if index.Format > ChunkIndexFormat {
+		return index, UnsupportedFormat{id, index.Format}
+	}
+
+	return index, nil
+}
+
+// chunkReader reads each chunk from the backend in turn as it is consumed,
+// verifying that every chunk's contents match its hash.
+type chunkReader struct {
+	backend Backend
+	chunks  []Chunk
+	current io.Reader
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.chunks) == 0 {
+				return 0, io.EOF
+			}
+
+			chunk := r.chunks[0]
+			r.chunks = r.chunks[1:]
+
+			reader, err := r.backend.Read(chunk.ID())
+			if err != nil {
+				return 0, err
+			}
+			r.current = newVerifyingReader(reader, chunk.ID(), chunk.Hash)
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
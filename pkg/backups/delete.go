@@ -0,0 +1,99 @@
+package backups
+
+import (
+	"fmt"
+)
+
+// DeleteVersion deletes version `id` of `name` and removes it from the lock.
+// The version may be given by its full ID or by only the version string it
+// was created with. Pinned versions, the current version and versions that
+// other versions are increments on top of are never deleted.
+//
+// The chunks of a deduplicated version may be shared with other versions, so
+// only the version's chunk index is deleted. The backend, and the shard
+// backends of an erasure coded version, must implement Deleter.
+func (m Manager) DeleteVersion(name string, id string) (Version, error) {
+	// The lock is stored first, so that a failure to delete the contents
+	// leaves unreferenced objects behind rather than a broken version.
+	var version Version
+	err := m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		var err error
+		if version, err = findVersion(lock, id); err != nil {
+			return Lock{}, err
+		}
+
+		if err = checkDeletable(lock, version); err != nil {
+			return Lock{}, err
+		}
+
+		return lock.Remove(version.ID), nil
+	})
+	if err != nil {
+		return Version{}, err
+	}
+
+	return version, m.deleteContents(version)
+}
+
+// checkDeletable returns an error if `version` must not be deleted from
+// `lock`.
+func checkDeletable(lock Lock, version Version) error {
+	if version.Pin != nil {
+		return VersionPinned{ID: version.ID, Reason: version.Pin.Reason}
+	}
+
+	if version.ID == lock.Current {
+		return fmt.Errorf("Version %s is the current version", version.ID)
+	}
+
+	for _, other := range lock.History() {
+		if other.Parent == version.ID {
+			return fmt.Errorf("Version %s is the parent of version %s", version.ID, other.ID)
+		}
+	}
+
+	return nil
+}
+
+// deleteContents deletes every object stored for `version`.
+func (m Manager) deleteContents(version Version) error {
+	deleter, ok := m.backend.(Deleter)
+	if !ok {
+		return fmt.Errorf("The backend does not support deleting versions")
+	}
+
+	var failures []string
+
+	if version.Manifest != "" {
+		if err := deleter.Delete(version.Manifest); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", version.Manifest, err))
+		}
+	}
+
+	if version.Layout == LayoutErasure && version.Shards != nil {
+		backends := make(map[string]Backend)
+		for _, shardBackend := range m.shardBackends {
+			backends[shardBackend.Name] = shardBackend.Backend
+		}
+
+		for _, shard := range version.Shards.Shards {
+			shardDeleter, ok := backends[shard.Backend].(Deleter)
+			if !ok {
+				failures = append(failures, fmt.Sprintf("%s: backend %s is not configured or cannot delete", shard.ID, shard.Backend))
+				continue
+			}
+
+			if err := shardDeleter.Delete(shard.ID); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", shard.ID, err))
+			}
+		}
+	} else if err := deleter.Delete(version.ID); err != nil {
+		failures = append(failures, fmt.Sprintf("%s: %v", version.ID, err))
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Version %s was removed from the lock, but some of its objects could not be deleted: %v", version.ID, failures)
+	}
+
+	return nil
+}
@@ -0,0 +1,355 @@
+package backups
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/samrap/systools/pkg/erasure"
+)
+
+// LayoutErasure is the layout of versions stored as Reed-Solomon shards spread
+// across several backends. The version's Shards describe where they are.
+const LayoutErasure = "erasure"
+
+// shardBlockSize is the number of bytes each shard holds of every stripe of a
+// version's contents. Contents are encoded one stripe at a time, so that
+// they never have to be held in memory in full.
+const shardBlockSize = 1024 * 1024
+
+// ShardBackend is a backend that shards of erasure coded versions are stored
+// on. Its name is recorded in the layout of each version, so that shards can
+// be found even if the order or number of configured backends changes.
+type ShardBackend struct {
+	Name    string
+	Backend Backend
+}
+
+// ShardLayout describes how an erasure coded version is split into shards.
+type ShardLayout struct {
+	DataShards   int   `json:"data_shards"`
+	ParityShards int   `json:"parity_shards"`
+	BlockSize    int64 `json:"block_size"`
+
+	// Size is the length of the contents as stored, after any transformers
+	// encoded them, which the padding of the final stripe is stripped to.
+	// It is zero for layouts recorded before it existed, whose contents were
+	// never encoded, so that the version's Size is used instead.
+	Size int64 `json:"size,omitempty"`
+
+	// Shards holds the location of each shard, data shards first.
+	Shards []Shard `json:"shards"`
+}
+
+// Shard is the location of a single shard of an erasure coded version.
+type Shard struct {
+	Backend  string `json:"backend"`
+	ID       string `json:"id"`
+	Checksum string `json:"checksum"`
+}
+
+// storeErasure encodes the contents of `reader` into data and parity shards and
+// stores each shard under `id` on a different shard backend.
+func (m Manager) storeErasure(id string, reader io.Reader) (*ShardLayout, error) {
+	coder, err := erasure.NewCoder(m.dataShards, m.parityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	count := m.dataShards + m.parityShards
+	if len(m.shardBackends) < count {
+		return nil, fmt.Errorf("Erasure coding with %d shards requires %d shard backends, but only %d are configured", count, count, len(m.shardBackends))
+	}
+
+	layout := &ShardLayout{
+		DataShards:   m.dataShards,
+		ParityShards: m.parityShards,
+		BlockSize:    shardBlockSize,
+		Shards:       make([]Shard, count),
+	}
+
+	// Each shard is streamed to its backend through a pipe as it is encoded.
+	writers := make([]*io.PipeWriter, count)
+	results := make(chan error, count)
+	for i := range writers {
+		shardReader, shardWriter := io.Pipe()
+		writers[i] = shardWriter
+		layout.Shards[i] = Shard{
+			Backend: m.shardBackends[i].Name,
+			ID:      fmt.Sprintf("%s.shard%d", id, i),
+		}
+
+		go func(shard *Shard, backend Backend) {
+			summer := newSummingReader(shardReader)
+			err := backend.Store(shard.ID, summer)
+			if err == nil {
+				// Consume anything the backend didn't, so it is summed.
+				_, err = io.Copy(ioutil.Discard, summer)
+				shard.Checksum = summer.Checksum()
+			}
+
+			// Unblock the encoder if the backend stopped reading early.
+			if err != nil {
+				shardReader.CloseWithError(err)
+			} else {
+				shardReader.Close()
+			}
+			results <- err
+		}(&layout.Shards[i], m.shardBackends[i].Backend)
+	}
+
+	layout.Size, err = encodeStripes(coder, reader, writers)
+	for _, writer := range writers {
+		writer.CloseWithError(err)
+	}
+
+	for range writers {
+		if storeErr := <-results; storeErr != nil && err == nil {
+			err = storeErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return layout, nil
+}
+
+// encodeStripes reads `reader` one stripe at a time, writing each shard's
+// block of the stripe to its writer. The final stripe is padded with zeros.
+// It returns the number of bytes read from `reader`.
+func encodeStripes(coder *erasure.Coder, reader io.Reader, writers []*io.PipeWriter) (int64, error) {
+	stripe := make([]byte, coder.DataShards()*shardBlockSize)
+	shards := make([][]byte, len(writers))
+	for i := range shards {
+		if i < coder.DataShards() {
+			shards[i] = stripe[i*shardBlockSize : (i+1)*shardBlockSize]
+		} else {
+			shards[i] = make([]byte, shardBlockSize)
+		}
+	}
+
+	var size int64
+	for {
+		n, err := io.ReadFull(reader, stripe)
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return size, err
+		}
+		size += int64(n)
+
+		for i := n; i < len(stripe); i++ {
+			stripe[i] = 0
+		}
+
+		if err := coder.Encode(shards); err != nil {
+			return size, err
+		}
+
+		for i, writer := range writers {
+			if _, err := writer.Write(shards[i]); err != nil {
+				return size, err
+			}
+		}
+
+		if n < len(stripe) {
+			return size, nil
+		}
+	}
+}
+
+// readErasure returns a reader of an erasure coded version, which reads the
+// data shards if they are available and reconstructs the contents from the
+// parity shards if some of them are not.
+func (m Manager) readErasure(version Version) (io.Reader, error) {
+	layout := version.Shards
+	if layout == nil {
+		return nil, fmt.Errorf("Version %s has no shard layout", version.ID)
+	}
+
+	coder, err := erasure.NewCoder(layout.DataShards, layout.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	backends := make(map[string]Backend)
+	for _, shardBackend := range m.shardBackends {
+		backends[shardBackend.Name] = shardBackend.Backend
+	}
+
+	size := layout.Size
+	if size == 0 {
+		size = version.Size
+	}
+
+	reader := &erasureReader{
+		coder:     coder,
+		id:        version.ID,
+		layout:    layout,
+		backends:  backends,
+		readers:   make([]io.Reader, len(layout.Shards)),
+		tried:     make([]bool, len(layout.Shards)),
+		blockSize: layout.BlockSize,
+		remaining: size,
+	}
+	if err = reader.open(); err != nil {
+		return nil, err
+	}
+
+	return reader, nil
+}
+
+// erasureReader reassembles erasure coded contents one stripe at a time.
+type erasureReader struct {
+	coder    *erasure.Coder
+	id       string
+	layout   *ShardLayout
+	backends map[string]Backend
+
+	// readers holds a reader of each shard being read, and tried marks the
+	// shards that were opened or failed to open.
+	readers  []io.Reader
+	tried    []bool
+	failures []string
+
+	blockSize int64
+	remaining int64
+
+	// offset is the number of bytes read from each shard so far.
+	offset int64
+	stripe []byte
+}
+
+// open opens shards that weren't tried yet until enough are available to
+// reconstruct the contents, preferring data shards since no reconstruction
+// is needed when they are all available. Shards opened partway through the
+// contents are read up to where the other shards are.
+func (r *erasureReader) open() error {
+	available := 0
+	for _, reader := range r.readers {
+		if reader != nil {
+			available++
+		}
+	}
+
+	for i, shard := range r.layout.Shards {
+		if available == r.layout.DataShards {
+			break
+		}
+		if r.tried[i] {
+			continue
+		}
+		r.tried[i] = true
+
+		backend, ok := r.backends[shard.Backend]
+		if !ok {
+			r.failures = append(r.failures, fmt.Sprintf("%s: backend %s is not configured", shard.ID, shard.Backend))
+			continue
+		}
+
+		reader, err := backend.Read(shard.ID)
+		if err != nil {
+			r.failures = append(r.failures, fmt.Sprintf("%s: %v", shard.ID, err))
+			continue
+		}
+
+		// The skipped bytes are read rather than skipped over, so that the
+		// shard's checksum is still verified.
+		reader = newVerifyingReader(reader, shard.ID, shard.Checksum)
+		if _, err = io.CopyN(ioutil.Discard, reader, r.offset); err != nil {
+			r.failures = append(r.failures, fmt.Sprintf("%s: %v", shard.ID, err))
+			continue
+		}
+
+		r.readers[i] = reader
+		available++
+	}
+
+	if available < r.layout.DataShards {
+		return fmt.Errorf("Only %d of the %d shards needed to restore %s are available: %v", available, r.layout.DataShards, r.id, r.failures)
+	}
+
+	return nil
+}
+
+func (r *erasureReader) Read(p []byte) (int, error) {
+	if len(r.stripe) == 0 {
+		if r.remaining == 0 {
+			return 0, r.finish()
+		}
+
+		if err := r.readStripe(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.stripe)
+	r.stripe = r.stripe[n:]
+
+	return n, nil
+}
+
+func (r *erasureReader) readStripe() error {
+	shards := make([][]byte, len(r.readers))
+	for {
+		failed := false
+		for i, reader := range r.readers {
+			if reader == nil || shards[i] != nil {
+				continue
+			}
+
+			block := make([]byte, r.blockSize)
+			if _, err := io.ReadFull(reader, block); err != nil {
+				// The shard is missing from here on, and is reconstructed
+				// from the other shards.
+				r.readers[i] = nil
+				r.failures = append(r.failures, fmt.Sprintf("%s: %v", r.layout.Shards[i].ID, err))
+				failed = true
+				continue
+			}
+			shards[i] = block
+		}
+
+		if !failed {
+			break
+		}
+		if err := r.open(); err != nil {
+			return err
+		}
+	}
+	r.offset += r.blockSize
+
+	if err := r.coder.ReconstructData(shards); err != nil {
+		return err
+	}
+
+	r.stripe = nil
+	for _, shard := range shards[:r.coder.DataShards()] {
+		r.stripe = append(r.stripe, shard...)
+	}
+
+	// Strip the padding of the final stripe.
+	if int64(len(r.stripe)) > r.remaining {
+		r.stripe = r.stripe[:r.remaining]
+	}
+	r.remaining -= int64(len(r.stripe))
+
+	return nil
+}
+
+// finish reads each shard to its end, which verifies its checksum.
+func (r *erasureReader) finish() error {
+	for i, reader := range r.readers {
+		if reader == nil {
+			continue
+		}
+
+		if _, err := io.Copy(ioutil.Discard, reader); err != nil {
+			return err
+		}
+		r.readers[i] = nil
+	}
+
+	return io.EOF
+}
@@ -0,0 +1,210 @@
+package backups
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// LockFormat is the format of the locks written by this version of the
+// package. Locks of earlier formats are upgraded when they are read, see
+// Lock.Upgrade, and locks of later formats are refused.
+const LockFormat = 1
+
+// ChunkIndexFormat is the format of the chunk indexes written by this
+// version of the package. Format 0 indexes are identical to format 1.
+const ChunkIndexFormat = 1
+
+// lockMigrations upgrade a lock from the format of their index to the next.
+var lockMigrations = []func(Lock) Lock{
+	// Format 0 locks may point to versions without a record.
+	func(l Lock) Lock {
+		l.Versions = l.History()
+		return l
+	},
+}
+
+// UnsupportedFormat is an error returned when reading an object written in a
+// newer format than this version of the package understands.
+type UnsupportedFormat struct {
+	Name   string
+	Format int
+}
+
+func (e UnsupportedFormat) Error() string {
+	return fmt.Sprintf("%s has format %d, which is newer than this version of systools supports", e.Name, e.Format)
+}
+
+// Upgrade returns the lock upgraded to LockFormat. Upgrading changes the
+// lock's contents, so it must be verified before it is upgraded.
+func (l Lock) Upgrade() Lock {
+	for l.Format < LockFormat {
+		l = lockMigrations[l.Format](l)
+		l.Format++
+	}
+
+	return l
+}
+
+// Migration is a lock that was upgraded to LockFormat or moved to the key
+// layout by Manager.Migrate.
+type Migration struct {
+	Name string
+	From int
+	To   int
+
+	// Moved is set if the lock was moved from the legacy key layout, see
+	// KeyNamespace.
+	Moved bool
+
+	// Canonical is the canonical name the lock was renamed to, if Name is
+	// not canonical, see CanonicalPath.
+	Canonical string
+
+	// Unresolved explains why a lock whose name is not canonical was not
+	// renamed. Its backup can't be found by the canonical names the
+	// command line uses.
+	Unresolved string
+}
+
+// Migrate upgrades every lock in the backend that was written in an earlier
+// format to LockFormat, and moves locks stored in the legacy key layout to
+// their key, and returns the migrated locks. Locks that are already up to
+// date are left untouched, so migrating is idempotent. If `dryRun` is true,
+// the locks that would be migrated are returned without changing them. The
+// backend must implement Lister.
+//
+// Moved locks are left in the legacy layout too, for earlier versions of
+// systools, but are no longer read once moved. Versions are not moved.
+//
+// Earlier versions of systools named backups by the path they were given,
+// which may be relative. Locks whose names are not canonical are renamed to
+// the canonical path recorded in their versions' metadata, which requires
+// the backend to implement Deleter, and are reported as Unresolved if they
+// can't be renamed.
+//
+// Signed locks are signed again when they are upgraded, which requires a
+// signing key. Manifests and chunk indexes of earlier
+// formats are read as they are, since their contents have not changed.
+func (m Manager) Migrate(dryRun bool) ([]Migration, error) {
+	lister, ok := m.backend.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("The backend does not support listing objects")
+	}
+
+	objects, err := lister.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, name := range lockNames(objects) {
+		migration, err := m.migrateLock(name, dryRun)
+		if err != nil {
+			return migrations, fmt.Errorf("Unable to migrate the lock of %s: %v", name, err)
+		}
+		if migration != nil {
+			migrations = append(migrations, *migration)
+		}
+	}
+
+	return migrations, nil
+}
+
+// migrateLock upgrades the lock of `name` to LockFormat and moves it to its
+// key, renaming it if its name is not canonical, and returns nil if it is
+// already up to date.
+func (m Manager) migrateLock(name string, dryRun bool) (*Migration, error) {
+	for attempt := 1; ; attempt++ {
+		lock, tag, err := m.readLockAt(name, lockKey(name))
+		moved := false
+		if err == nil && lock == nil {
+			// Storing a lock read from the legacy layout without a tag
+			// moves it, unless another writer moved it in the meantime.
+			lock, _, err = m.readLockAt(name, legacyLockKey(name))
+			moved = true
+		}
+		if err != nil || lock == nil {
+			return nil, err
+		}
+
+		migration := &Migration{Name: name, From: lock.Format, To: LockFormat, Moved: moved}
+		if canonical, err := CanonicalPath(filepath.FromSlash(name)); err != nil || canonical != name {
+			if migration.Canonical, migration.Unresolved, err = m.canonicalName(*lock); err != nil {
+				return nil, err
+			}
+		}
+		upToDate := lock.Format == LockFormat && !moved && migration.Canonical == ""
+		if upToDate && migration.Unresolved == "" {
+			return nil, nil
+		}
+		if dryRun || upToDate {
+			return migration, nil
+		}
+
+		// Locks that are only moved keep their signature.
+		if lock.Signature != nil && m.signingKey == nil && (lock.Format != LockFormat || migration.Canonical != "") {
+			return nil, fmt.Errorf("The lock is signed, so migrating it requires a signing key")
+		}
+
+		upgraded := lock.Upgrade()
+		if migration.Canonical != "" {
+			// The lock is stored under its canonical name only if no
+			// backup exists there yet, and then removed from its name.
+			upgraded.Name, tag = migration.Canonical, ""
+		}
+
+		err = m.storeLock(upgraded, tag)
+		if _, ok := err.(Conflict); ok && attempt < lockAttempts {
+			// The lock was changed, and is checked again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if migration.Canonical != "" {
+			deleter := m.backend.(Deleter)
+			for _, key := range []string{lockKey(name), legacyLockKey(name)} {
+				if err = deleter.Delete(key); err != nil {
+					return nil, fmt.Errorf("Moved the lock to %s, but could not delete it from %s: %v", migration.Canonical, key, err)
+				}
+			}
+		}
+
+		return migration, nil
+	}
+}
+
+// canonicalName returns the canonical path the backup of `lock` was made
+// from, as recorded in the metadata of its newest version that has any, to
+// rename the lock to. If the lock can't be renamed, it returns why instead.
+func (m Manager) canonicalName(lock Lock) (string, string, error) {
+	var path string
+	for i := len(lock.Versions) - 1; i >= 0 && path == ""; i-- {
+		if metadata := lock.Versions[i].Metadata; metadata != nil && filepath.IsAbs(metadata.Path) {
+			path = metadata.Path
+		}
+	}
+	if path == "" {
+		return "", "no version records the path it was backed up from", nil
+	}
+
+	canonical, err := CanonicalPath(path)
+	if err != nil {
+		return "", "", err
+	}
+
+	existing, _, err := m.readLock(canonical)
+	if err != nil {
+		return "", "", err
+	}
+	if existing != nil {
+		return "", fmt.Sprintf("%s already has a backup", canonical), nil
+	}
+
+	if _, ok := m.backend.(Deleter); !ok {
+		return "", "the backend does not support deleting locks", nil
+	}
+
+	return canonical, "", nil
+}
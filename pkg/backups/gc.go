@@ -0,0 +1,204 @@
+package backups
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// shardPattern matches the names erasure coded shards are stored under, in
+// either key layout.
+var shardPattern = regexp.MustCompile(`(\.bak|^` + KeyNamespace + `/[^/]+/versions/[^/]+)\.shard\d+$`)
+
+// Orphan is a stored object that no lock refers to.
+type Orphan struct {
+	// Backend is the name of the shard backend the object is stored on, or
+	// empty if it is stored on the Manager's backend.
+	Backend string
+	Object
+}
+
+// GC finds the objects holding version contents, manifests, chunks and
+// shards that are not referred to by any lock and were last modified more
+// than `grace` ago, and deletes them unless `dryRun` is true. Objects are
+// orphaned when a backup fails before its lock is stored, or when deleting
+// a version fails after its lock was stored.
+//
+// The grace period protects the objects of backups still in progress, so it
+// must be longer than any backup takes. Chunks are not collected at all
+// while any backup holds a lease, since a deduplicating backup reuses
+// existing chunks, however old, before its lock refers to them. The
+// backend, and any shard backends to collect from, must implement Lister
+// and Deleter. GC returns an error without deleting anything if any lock
+// cannot be read or verified.
+func (m Manager) GC(grace time.Duration, dryRun bool) ([]Orphan, error) {
+	lister, ok := m.backend.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("The backend does not support listing objects")
+	}
+
+	objects, err := lister.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	referenced, err := m.referencedObjects(objects)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-grace)
+	isOrphan := func(object Object) bool {
+		return isContentObject(object.Name) && !referenced[object.Name] && object.LastModified.Before(cutoff)
+	}
+
+	backends := map[string]Backend{"": m.backend}
+	var orphans []Orphan
+	for _, object := range objects {
+		if isOrphan(object) {
+			orphans = append(orphans, Orphan{Object: object})
+		}
+	}
+
+	for _, shardBackend := range m.shardBackends {
+		lister, ok := shardBackend.Backend.(Lister)
+		if !ok {
+			continue
+		}
+
+		objects, err := lister.List("")
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list shard backend %s: %v", shardBackend.Name, err)
+		}
+
+		backends[shardBackend.Name] = shardBackend.Backend
+		for _, object := range objects {
+			if isOrphan(object) {
+				orphans = append(orphans, Orphan{Backend: shardBackend.Name, Object: object})
+			}
+		}
+	}
+
+	// The leases are read after the locks, so that any backup that might have
+	// reused an orphaned chunk since is found.
+	running, err := m.runningBackups()
+	if err != nil {
+		return nil, err
+	}
+	if len(running) > 0 {
+		var kept []Orphan
+		for _, orphan := range orphans {
+			if orphan.Backend != "" || !strings.HasPrefix(orphan.Name, "chunks/") {
+				kept = append(kept, orphan)
+			}
+		}
+		orphans = kept
+	}
+
+	if dryRun {
+		return orphans, nil
+	}
+
+	var failures []string
+	for _, orphan := range orphans {
+		deleter, ok := backends[orphan.Backend].(Deleter)
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s: the backend does not support deleting objects", orphan.Name))
+			continue
+		}
+
+		if err := deleter.Delete(orphan.Name); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", orphan.Name, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return orphans, fmt.Errorf("Some orphaned objects could not be deleted: %v", failures)
+	}
+
+	return orphans, nil
+}
+
+// runningBackups returns the names of the backups holding an unexpired
+// lease.
+func (m Manager) runningBackups() ([]string, error) {
+	objects, err := m.backend.(Lister).List(KeyNamespace + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	var running []string
+	for _, object := range objects {
+		name, rest, ok := parseKey(object.Name)
+		if !ok || rest != "lease" {
+			continue
+		}
+
+		lease, err := m.Lease(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the lease of %s: %v", name, err)
+		}
+		if lease != nil && !lease.Expired(time.Now()) {
+			running = append(running, name)
+		}
+	}
+
+	return running, nil
+}
+
+// referencedObjects returns the names of every object referred to by the
+// locks among `objects`, directly or through a chunk index.
+func (m Manager) referencedObjects(objects []Object) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+
+	for _, name := range lockNames(objects) {
+		lock, err := m.getCurrentLock(name)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read the lock of %s: %v", name, err)
+		}
+		if lock == nil {
+			continue
+		}
+
+		for _, version := range lock.History() {
+			referenced[version.ID] = true
+			if version.Manifest != "" {
+				referenced[version.Manifest] = true
+			}
+
+			if version.Shards != nil {
+				for _, shard := range version.Shards.Shards {
+					referenced[shard.ID] = true
+				}
+			}
+
+			if version.Layout == LayoutChunked {
+				index, err := m.readChunkIndex(version.ID)
+				if err != nil {
+					return nil, fmt.Errorf("Unable to read the chunk index of %s: %v", version.ID, err)
+				}
+
+				for _, chunk := range index.Chunks {
+					referenced[chunk.ID()] = true
+				}
+			}
+		}
+	}
+
+	return referenced, nil
+}
+
+// isContentObject returns whether `name` is the name of an object holding
+// version contents, a manifest, a chunk or a shard, which are the only
+// objects garbage collection may delete.
+func isContentObject(name string) bool {
+	if _, rest, ok := parseKey(name); ok {
+		return strings.HasPrefix(rest, "versions/")
+	}
+
+	return strings.HasSuffix(name, ".bak") ||
+		strings.HasSuffix(name, ".manifest") ||
+		strings.HasPrefix(name, "chunks/") ||
+		shardPattern.MatchString(name)
+}
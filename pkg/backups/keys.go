@@ -0,0 +1,201 @@
+package backups
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// KeyNamespace is the prefix of the keys of every backup's objects.
+//
+// Each backup's objects are stored under keys of the following layout, where
+// <name> is the backup's name encoded by encodeName, so that it is always a
+// single path segment:
+//
+//	backups/<name>/lock                          the lock
+//	backups/<name>/lease                         the lease of a running backup
+//	backups/<name>/versions/<version>            the contents of a version
+//	backups/<name>/versions/<version>.manifest   the manifest of a version
+//	backups/<name>/versions/<version>.shard<i>   a shard of a version
+//	chunks/<sha256>                              a chunk of deduplicated versions
+//	backups/conditional-writes                   see S3Backend.StoreIf
+//
+// Backups stored before this layout existed used the name as is, in the
+// legacy layout "<name>.lock", "<name>.lease" and "<name>_<version>.bak".
+// Their locks are still read, and are moved to the layout the next time they
+// are written, see Manager.Migrate. Versions are recorded in the lock by
+// their keys, so versions stored in the legacy layout are read where they
+// are.
+const KeyNamespace = "backups"
+
+// CanonicalPath returns the canonical name of the backup of the file or
+// directory at `path`: its absolute, cleaned path with forward slashes. The
+// same file or directory has the same name however it is referred to.
+func CanonicalPath(path string) (string, error) {
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(abspath), nil
+}
+
+// encodeName encodes `name` into a single path segment, by percent-encoding
+// every byte other than ASCII letters, digits, '-', '.', '_' and '~'. Names
+// consisting only of dots are encoded in full, since "." and ".." are not
+// usable as path segments. The encoding is unambiguous, see decodeName.
+func encodeName(name string) string {
+	if strings.Trim(name, ".") == "" {
+		return strings.Repeat("%2E", len(name))
+	}
+
+	var encoded strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+
+	return encoded.String()
+}
+
+// decodeName decodes a name encoded by encodeName.
+func decodeName(segment string) (string, error) {
+	var name strings.Builder
+	for i := 0; i < len(segment); i++ {
+		if segment[i] != '%' {
+			name.WriteByte(segment[i])
+			continue
+		}
+
+		if i+2 >= len(segment) {
+			return "", fmt.Errorf("Invalid encoded name %s", segment)
+		}
+		c, err := strconv.ParseUint(segment[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("Invalid encoded name %s", segment)
+		}
+		name.WriteByte(byte(c))
+		i += 2
+	}
+
+	return name.String(), nil
+}
+
+// backupKey returns the key of `object` among the objects of `name`.
+func backupKey(name string, object string) string {
+	return fmt.Sprintf("%s/%s/%s", KeyNamespace, encodeName(name), object)
+}
+
+func lockKey(name string) string {
+	return backupKey(name, "lock")
+}
+
+func leaseKey(name string) string {
+	return backupKey(name, "lease")
+}
+
+// versionKey returns the key the contents of version `version` of `name` are
+// stored under, which is the version's ID.
+func versionKey(name string, version string) string {
+	return backupKey(name, "versions/"+version)
+}
+
+// manifestKey returns the key the manifest of the version with ID `id` is
+// stored under.
+func manifestKey(id string) string {
+	if strings.HasSuffix(id, ".bak") {
+		return strings.TrimSuffix(id, ".bak") + ".manifest"
+	}
+
+	return id + ".manifest"
+}
+
+func legacyLockKey(name string) string {
+	return fmt.Sprintf("%s.lock", name)
+}
+
+func legacyVersionKey(name string, version string) string {
+	return fmt.Sprintf("%s_%s.bak", name, version)
+}
+
+// parseKey returns the name of the backup that `key` belongs to in the key
+// layout, and the rest of the key after the name, such as "lock" or
+// "versions/<version>".
+func parseKey(key string) (string, string, bool) {
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) != 3 || parts[0] != KeyNamespace {
+		return "", "", false
+	}
+
+	name, err := decodeName(parts[1])
+	if err != nil || encodeName(name) != parts[1] {
+		return "", "", false
+	}
+
+	return name, parts[2], true
+}
+
+// lockName returns the name of the backup whose lock is stored under `key`,
+// in either key layout.
+func lockName(key string) (string, bool) {
+	if name, rest, ok := parseKey(key); ok {
+		return name, rest == "lock"
+	}
+
+	if strings.HasSuffix(key, ".lock") {
+		return strings.TrimSuffix(key, ".lock"), true
+	}
+
+	return "", false
+}
+
+// lockNames returns the sorted names of the backups with a lock among
+// `objects`, in either key layout.
+func lockNames(objects []Object) []string {
+	names := make(map[string]bool)
+	for _, object := range objects {
+		if name, ok := lockName(object.Name); ok {
+			names[name] = true
+		}
+	}
+
+	return sortedNames(names)
+}
+
+// parseVersionKey returns the name of the backup and the version that the
+// contents stored under `key` belong to, in either key layout. Versions in
+// the legacy layout are assumed not to contain an underscore, see
+// versionPattern.
+func parseVersionKey(key string) (string, string, bool) {
+	if name, rest, ok := parseKey(key); ok {
+		version := strings.TrimPrefix(rest, "versions/")
+		if version == rest || version == "" || strings.Contains(version, "/") ||
+			strings.HasSuffix(version, ".manifest") || shardPattern.MatchString(key) {
+			return "", "", false
+		}
+
+		return name, version, true
+	}
+
+	if match := versionPattern.FindStringSubmatch(key); match != nil {
+		return match[1], match[2], true
+	}
+
+	return "", "", false
+}
+
+// ShortVersion returns the version part of the ID of a version stored in the
+// key layout, which identifies it among the versions of its backup, or the
+// ID as is for versions stored in the legacy layout.
+func ShortVersion(id string) string {
+	if _, rest, ok := parseKey(id); ok && strings.HasPrefix(rest, "versions/") {
+		return strings.TrimPrefix(rest, "versions/")
+	}
+
+	return id
+}
@@ -0,0 +1,211 @@
+package backups
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Labels are key/value pairs annotating a version, such as "release=v4.2" or
+// "reason=pre-upgrade". Keys consist of ASCII letters, digits, '-', '_', '.'
+// and '/', while values may be anything.
+type Labels map[string]string
+
+// ParseLabels parses labels given as "key=value" pairs.
+func ParseLabels(pairs []string) (Labels, error) {
+	labels := make(Labels)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid label %s, labels must be given as key=value", pair)
+		}
+		labels[parts[0]] = parts[1]
+	}
+
+	return labels, labels.Validate()
+}
+
+// Validate returns an error if any key of the labels is invalid.
+func (l Labels) Validate() error {
+	for key := range l {
+		if !isLabelKey(key) {
+			return fmt.Errorf("Invalid label key %q, keys may only contain letters, digits, '-', '_', '.' and '/'", key)
+		}
+	}
+
+	return nil
+}
+
+// String formats the labels as comma separated "key=value" pairs, sorted by
+// key.
+func (l Labels) String() string {
+	pairs := make([]string, 0, len(l))
+	for key, value := range l {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", key, value))
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, ",")
+}
+
+// merge returns a copy of the labels with `labels` added, replacing the
+// values of existing keys.
+func (l Labels) merge(labels Labels) Labels {
+	if len(labels) == 0 {
+		return l
+	}
+
+	merged := make(Labels, len(l)+len(labels))
+	for key, value := range l {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+func isLabelKey(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_./", c) >= 0) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Requirement is a single requirement of a Selector on the labels of a
+// version.
+type Requirement struct {
+	Key string
+
+	// Value is the value the label must have. If HasValue is false, the
+	// label may have any value.
+	Value    string
+	HasValue bool
+
+	// Negated inverts the requirement, so that the label must not have
+	// Value, or must not exist at all if HasValue is false.
+	Negated bool
+}
+
+// Matches returns whether `labels` meet the requirement.
+func (r Requirement) Matches(labels Labels) bool {
+	value, ok := labels[r.Key]
+	matches := ok && (!r.HasValue || value == r.Value)
+
+	return matches != r.Negated
+}
+
+func (r Requirement) String() string {
+	switch {
+	case r.HasValue && r.Negated:
+		return fmt.Sprintf("%s!=%s", r.Key, r.Value)
+	case r.HasValue:
+		return fmt.Sprintf("%s=%s", r.Key, r.Value)
+	case r.Negated:
+		return "!" + r.Key
+	}
+
+	return r.Key
+}
+
+// Selector selects versions by their labels. A version is selected if its
+// labels meet every requirement of the selector, so an empty selector
+// selects every version.
+type Selector []Requirement
+
+// ParseSelector parses a selector from requirements given as "key=value",
+// "key!=value", "key" for a label to exist or "!key" for a label not to
+// exist.
+func ParseSelector(expressions []string) (Selector, error) {
+	var selector Selector
+	for _, expression := range expressions {
+		var requirement Requirement
+		if i := strings.Index(expression, "!="); i >= 0 {
+			requirement = Requirement{Key: expression[:i], Value: expression[i+2:], HasValue: true, Negated: true}
+		} else if i := strings.Index(expression, "="); i >= 0 {
+			requirement = Requirement{Key: expression[:i], Value: expression[i+1:], HasValue: true}
+		} else if strings.HasPrefix(expression, "!") {
+			requirement = Requirement{Key: expression[1:], Negated: true}
+		} else {
+			requirement = Requirement{Key: expression}
+		}
+
+		if !isLabelKey(requirement.Key) {
+			return nil, fmt.Errorf("Invalid selector %s, its label key is invalid", expression)
+		}
+		selector = append(selector, requirement)
+	}
+
+	return selector, nil
+}
+
+// Matches returns whether `labels` meet every requirement of the selector.
+func (s Selector) Matches(labels Labels) bool {
+	for _, requirement := range s {
+		if !requirement.Matches(labels) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s Selector) String() string {
+	requirements := make([]string, len(s))
+	for i, requirement := range s {
+		requirements[i] = requirement.String()
+	}
+
+	return strings.Join(requirements, ",")
+}
+
+// WithLabels records `labels` in the new version. If no new version is
+// created because the contents are unchanged, see SkipUnchanged and
+// ContentVersioner, the labels are added to the existing version instead.
+func WithLabels(labels Labels) BackupOption {
+	return func(o *backupOptions) {
+		o.labels = o.labels.merge(labels)
+	}
+}
+
+// Select returns the records of the versions of `name` whose labels match
+// `selector`, oldest first.
+func (m Manager) Select(name string, selector Selector) ([]Version, error) {
+	versions, err := m.Versions(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []Version
+	for _, version := range versions {
+		if selector.Matches(version.Labels) {
+			selected = append(selected, version)
+		}
+	}
+
+	return selected, nil
+}
+
+// Latest returns the record of the newest version of `name` whose labels
+// match `selector`.
+func (m Manager) Latest(name string, selector Selector) (Version, error) {
+	versions, err := m.Select(name, selector)
+	if err != nil {
+		return Version{}, err
+	}
+
+	if len(versions) == 0 {
+		return Version{}, fmt.Errorf("No version of %s matches %s", name, selector)
+	}
+
+	return versions[len(versions)-1], nil
+}
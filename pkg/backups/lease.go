@@ -0,0 +1,267 @@
+package backups
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultLeaseTTL is how long a backup's lease lasts without being renewed.
+// Leases are renewed well before they expire for as long as the backup runs.
+const DefaultLeaseTTL = 5 * time.Minute
+
+// Lease is held by a backup of a name while it runs, so that only one backup
+// of the name runs at a time. A lease that has expired was left behind by a
+// backup that stopped without releasing it, and is taken over by the next
+// backup.
+type Lease struct {
+	Name string `json:"name"`
+
+	// Holder identifies the backup holding the lease.
+	Holder string `json:"holder"`
+	Host   string `json:"host"`
+	PID    int    `json:"pid"`
+
+	AcquiredAt time.Time `json:"acquired_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// ID returns the ID this lease should be stored under.
+func (l Lease) ID() string {
+	return leaseKey(l.Name)
+}
+
+// Expired returns whether the lease had expired at `now`.
+func (l Lease) Expired(now time.Time) bool {
+	return !now.Before(l.ExpiresAt)
+}
+
+// LeaseHeld is an error returned by Manager.Backup when another backup of the
+// same name holds an unexpired lease.
+type LeaseHeld struct {
+	Lease Lease
+}
+
+func (e LeaseHeld) Error() string {
+	return fmt.Sprintf("a backup of %s is already running on %s (pid %d), its lease expires at %s",
+		e.Lease.Name, e.Lease.Host, e.Lease.PID, e.Lease.ExpiresAt.Local().Format(time.RFC3339))
+}
+
+// WithLeaseTTL configures how long the lease held by each backup lasts
+// without being renewed, which is how long a backup that stopped without
+// releasing its lease blocks other backups of the same name.
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(m *Manager) {
+		m.leaseTTL = ttl
+	}
+}
+
+// Lease returns the lease of `name`, or nil if no backup of `name` holds one.
+// The returned lease may have expired.
+func (m Manager) Lease(name string) (*Lease, error) {
+	lease, _, err := m.readLease(name)
+
+	return lease, err
+}
+
+// Unlock removes the lease of `name`, whether or not it has expired, so that
+// the next backup of `name` can run. It returns the removed lease, or nil if
+// there was none. This must only be used if the backup holding the lease is
+// known to have stopped. The backend must implement Deleter.
+func (m Manager) Unlock(name string) (*Lease, error) {
+	lease, _, err := m.readLease(name)
+	if err != nil || lease == nil {
+		return nil, err
+	}
+
+	deleter, ok := m.backend.(Deleter)
+	if !ok {
+		return nil, fmt.Errorf("The backend does not support deleting leases")
+	}
+
+	return lease, deleter.Delete(lease.ID())
+}
+
+// heldLease is a lease held by a running backup, which renews it until it is
+// released.
+type heldLease struct {
+	manager Manager
+	lease   Lease
+	tag     string
+
+	// err is set if the lease could not be renewed, after which it may be
+	// held by another backup.
+	err error
+	mu  sync.Mutex
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquireLease acquires the lease of `name`, taking it over if it has
+// expired, and starts renewing it. It returns LeaseHeld if another backup
+// holds it.
+func (m Manager) acquireLease(name string) (*heldLease, error) {
+	holder := make([]byte, 16)
+	if _, err := rand.Read(holder); err != nil {
+		return nil, err
+	}
+
+	host, _ := os.Hostname()
+	now := time.Now()
+	lease := Lease{
+		Name:       name,
+		Holder:     hex.EncodeToString(holder),
+		Host:       host,
+		PID:        os.Getpid(),
+		AcquiredAt: now,
+		ExpiresAt:  now.Add(m.leaseTTL),
+	}
+
+	for attempt := 1; ; attempt++ {
+		current, tag, err := m.readLease(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if current != nil && !current.Expired(time.Now()) {
+			return nil, LeaseHeld{*current}
+		}
+
+		tag, err = m.storeLease(lease, tag)
+		if _, ok := err.(Conflict); ok && attempt < lockAttempts {
+			// Another backup stored the lease first, which is reported
+			// as held when it is read again.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		held := &heldLease{
+			manager: m,
+			lease:   lease,
+			tag:     tag,
+			stop:    make(chan struct{}),
+			done:    make(chan struct{}),
+		}
+		go held.renew()
+
+		return held, nil
+	}
+}
+
+// renew renews the lease every third of its TTL until it is released.
+func (h *heldLease) renew() {
+	defer close(h.done)
+
+	interval := h.manager.leaseTTL / 3
+	if interval <= 0 {
+		interval = h.manager.leaseTTL
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+			h.lease.ExpiresAt = time.Now().Add(h.manager.leaseTTL)
+
+			tag, err := h.manager.storeLease(h.lease, h.tag)
+			if err != nil {
+				h.mu.Lock()
+				h.err = err
+				h.mu.Unlock()
+				return
+			}
+			h.tag = tag
+		}
+	}
+}
+
+// Err returns an error if the lease could not be renewed, in which case
+// another backup may have taken it over.
+func (h *heldLease) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.err != nil {
+		return fmt.Errorf("Lost the lease of %s: %v", h.lease.Name, h.err)
+	}
+
+	return nil
+}
+
+// release stops renewing the lease and deletes it, unless another backup has
+// taken it over. If the backend can't delete it, the lease is left to expire.
+func (h *heldLease) release() error {
+	close(h.stop)
+	<-h.done
+
+	current, _, err := h.manager.readLease(h.lease.Name)
+	if err != nil || current == nil || current.Holder != h.lease.Holder {
+		return err
+	}
+
+	if deleter, ok := h.manager.backend.(Deleter); ok {
+		return deleter.Delete(h.lease.ID())
+	}
+
+	return nil
+}
+
+// readLease reads the lease of `name` along with its tag, see readLock.
+func (m Manager) readLease(name string) (*Lease, string, error) {
+	reader, tag, err := readTagged(m.backend, Lease{Name: name}.ID())
+	if err != nil {
+		if _, ok := err.(NoSuchName); ok {
+			return nil, "", nil
+		}
+		return nil, "", err
+	}
+
+	leaseBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var lease Lease
+	if err = json.Unmarshal(leaseBytes, &lease); err != nil {
+		return nil, "", fmt.Errorf("Invalid lease %s: %v", Lease{Name: name}.ID(), err)
+	}
+
+	return &lease, tag, nil
+}
+
+// storeLease stores `lease` if the stored lease still has `tag`, returning
+// the new tag of the stored lease.
+func (m Manager) storeLease(lease Lease, tag string) (string, error) {
+	leaseBytes, err := json.Marshal(lease)
+	if err != nil {
+		return "", err
+	}
+
+	if err = storeIf(m.backend, lease.ID(), bytes.NewReader(leaseBytes), tag); err != nil {
+		return "", err
+	}
+
+	// Read the tag back, since storing doesn't return it.
+	current, tag, err := m.readLease(lease.Name)
+	if err != nil {
+		return "", err
+	}
+	if current == nil || current.Holder != lease.Holder {
+		return "", Conflict{lease.ID()}
+	}
+
+	return tag, nil
+}
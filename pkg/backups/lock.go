@@ -11,17 +11,112 @@ import (
 // A single back up may have many versions. The lock file is used to point to
 // the current version to restore from as well as the previous version as
 // an easy way to roll back. It also provides flexibility to point to
-// an even older version by locking Lock.Current to any version.
+// an even older version by locking Lock.Current to any version, since it
+// keeps a record of every version ever backed up under its name. See
+// Manager.Rollback.
 type Lock struct {
+	// Format is the format the lock was written in, see LockFormat. It is
+	// omitted for format 0, so that the signatures of locks written before
+	// it existed still verify.
+	Format int `json:"format,omitempty"`
+
 	Name      string    `json:"name"`
 	Current   string    `json:"current"`
 	Previous  string    `json:"previous"`
 	CreatedAt time.Time `json:"created_at"`
+
+	// Versions holds a record for every version of the backup, oldest
+	// first, which includes the checksum used to verify the version when
+	// restoring.
+	Versions []Version `json:"versions,omitempty"`
+
+	// Rollbacks records every time Current was pointed back to an older
+	// version, oldest first.
+	Rollbacks []Rollback `json:"rollbacks,omitempty"`
+
+	// Retention is the policy used to prune old versions of the backup. It
+	// is nil if every version is kept.
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+
+	// Signature is an ed25519 signature of the lock's other fields. It is
+	// empty if the lock was written by a Manager without a signing key.
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// Version is a record of a single stored version of a backup.
+type Version struct {
+	// ID is the name the version's contents are stored under in the backend.
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+
+	// Host is the hostname of the machine the version was backed up from.
+	Host string `json:"host,omitempty"`
+
+	// Checksum is the hex encoded SHA-256 sum of the version's contents.
+	Checksum string `json:"checksum"`
+
+	// Layout describes how the contents are stored under ID. It is empty if
+	// the contents are stored as is.
+	Layout string `json:"layout,omitempty"`
+
+	// Transforms lists the names of the Transformer stages the contents were
+	// encoded with, in the order they were applied.
+	Transforms []string `json:"transforms,omitempty"`
+
+	// Shards describes where the shards of an erasure coded version are.
+	Shards *ShardLayout `json:"shards,omitempty"`
+
+	// Parent is the ID of the version this version is an increment on top
+	// of. It is empty for versions which hold complete contents.
+	Parent string `json:"parent,omitempty"`
+
+	// Manifest is the ID of an object describing the version's contents,
+	// such as the file manifest of an incremental directory backup.
+	Manifest         string `json:"manifest,omitempty"`
+	ManifestChecksum string `json:"manifest_checksum,omitempty"`
+
+	// VerifiedAt is the last time a backup found the contents unchanged
+	// from this version, in place of storing an identical version.
+	VerifiedAt *time.Time `json:"verified_at,omitempty"`
+
+	// Pin is set if the version must never be deleted, see Manager.Pin.
+	Pin *Pin `json:"pin,omitempty"`
+
+	// Metadata describes the file the version was backed up from, if it
+	// was backed up from a single file.
+	Metadata *FileMetadata `json:"metadata,omitempty"`
+
+	// Labels annotate the version, see WithLabels.
+	Labels Labels `json:"labels,omitempty"`
+
+	// Message describes why the version was backed up, see WithMessage.
+	Message string `json:"message,omitempty"`
+
+	// Author is the user and hostname the version was backed up by, in the
+	// format "user@host".
+	Author string `json:"author,omitempty"`
+
+	// SystoolsVersion is the version of systools the version was backed up
+	// with.
+	SystoolsVersion string `json:"systools_version,omitempty"`
+}
+
+// Rollback is a record of the lock being pointed from one version back to
+// another.
+type Rollback struct {
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Host is the hostname of the machine the rollback was made from.
+	Host string `json:"host,omitempty"`
 }
 
 // NewLock creates a new lock with a name, current and previous versions.
 func NewLock(name string, current string, previous string) Lock {
 	return Lock{
+		Format:    LockFormat,
 		Name:      name,
 		Current:   current,
 		Previous:  previous,
@@ -36,12 +131,141 @@ func NewLockFromBytes(bytes []byte) (Lock, error) {
 	return l, json.Unmarshal(bytes, &l)
 }
 
+// CorruptLock is an error returned when a stored lock can't be decoded.
+type CorruptLock struct {
+	Name string
+	Err  error
+}
+
+func (e CorruptLock) Error() string {
+	return fmt.Sprintf("the lock %s could not be decoded: %v", e.Name, e.Err)
+}
+
 // ID returns the ID this lock should be stored under.
 func (l Lock) ID() string {
-	return fmt.Sprintf("%s.lock", l.Name)
+	return lockKey(l.Name)
 }
 
-// Shift returns a new Lock advanced forward to the next version.
+// Shift returns a new Lock advanced forward to the next version, keeping the
+// records of every version and rollback and the retention policy.
 func (l Lock) Shift(next string) Lock {
-	return NewLock(l.Name, next, l.Current)
+	shifted := NewLock(l.Name, next, l.Current)
+	shifted.Versions = l.History()
+	shifted.Rollbacks = l.Rollbacks
+	shifted.Retention = l.Retention
+
+	return shifted
+}
+
+// History returns the records of every version of the backup, oldest first.
+// Locks written before every version was recorded may point to versions
+// without a record, which are included with only their ID.
+func (l Lock) History() []Version {
+	versions := l.Versions
+	for _, id := range []string{l.Previous, l.Current} {
+		if id != "" && !l.hasRecord(id) {
+			versions = append(versions[:len(versions):len(versions)], Version{ID: id})
+		}
+	}
+
+	return versions
+}
+
+// Version returns the record for version `id`, if it is a version of the
+// backup.
+func (l Lock) Version(id string) (Version, bool) {
+	for _, version := range l.History() {
+		if version.ID == id {
+			return version, true
+		}
+	}
+
+	return Version{}, false
+}
+
+func (l Lock) hasRecord(id string) bool {
+	for _, version := range l.Versions {
+		if version.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Record returns a new Lock with `version` added to its version records. An
+// existing record with the same ID is replaced in place.
+func (l Lock) Record(version Version) Lock {
+	versions := make([]Version, len(l.Versions), len(l.Versions)+1)
+	copy(versions, l.Versions)
+	l.Versions = versions
+
+	for i, v := range l.Versions {
+		if v.ID == version.ID {
+			l.Versions[i] = version
+			return l
+		}
+	}
+	l.Versions = append(l.Versions, version)
+
+	return l
+}
+
+// Chain returns the records needed to restore version `id`, starting with the
+// most recent version holding complete contents and ending with `id` itself.
+func (l Lock) Chain(id string) ([]Version, error) {
+	var chain []Version
+
+	for id != "" {
+		version, ok := l.Version(id)
+		if !ok {
+			return nil, fmt.Errorf("Version %s is missing from lock %s", id, l.ID())
+		}
+		if len(chain) > len(l.Versions) {
+			return nil, fmt.Errorf("Version %s has a cyclic chain in lock %s", id, l.ID())
+		}
+
+		chain = append([]Version{version}, chain...)
+		id = version.Parent
+	}
+
+	return chain, nil
+}
+
+// RollBack returns a new Lock pointing back to version `id`, which must be a
+// version of the backup, with the rollback added to its records.
+func (l Lock) RollBack(id string, host string) (Lock, error) {
+	if _, ok := l.Version(id); !ok {
+		return Lock{}, fmt.Errorf("Version %s is missing from lock %s", id, l.ID())
+	}
+	if id == l.Current {
+		return Lock{}, fmt.Errorf("Version %s is already the current version", id)
+	}
+
+	rolledBack := l.Shift(id)
+	rolledBack.Rollbacks = append(l.Rollbacks[:len(l.Rollbacks):len(l.Rollbacks)], Rollback{
+		From:      l.Current,
+		To:        id,
+		CreatedAt: rolledBack.CreatedAt,
+		Host:      host,
+	})
+
+	return rolledBack, nil
+}
+
+// Remove returns a new Lock without the record of version `id`.
+func (l Lock) Remove(id string) Lock {
+	versions := make([]Version, 0, len(l.Versions))
+	for _, version := range l.Versions {
+		if version.ID != id {
+			versions = append(versions, version)
+		}
+	}
+	l.Versions = versions
+
+	if l.Previous == id {
+		l.Previous = ""
+	}
+
+	return l
 }
@@ -2,67 +2,801 @@ package backups
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"os/user"
+	"time"
+
+	systools "github.com/samrap/systools/pkg/version"
+)
+
+// lockAttempts is the number of times a lock update is attempted when other
+// writers keep changing the lock, and lockRetryDelay is the longest time
+// waited before the first retry.
+const (
+	lockAttempts   = 5
+	lockRetryDelay = 200 * time.Millisecond
 )
 
 // Manager performs versioned backup and restoration of files.
 type Manager struct {
 	backend   Backend
 	versioner Versioner
+
+	// signingKey signs every lock the Manager writes, if set.
+	signingKey ed25519.PrivateKey
+
+	// verifyKey is used to verify every lock the Manager reads, if set.
+	verifyKey ed25519.PublicKey
+
+	// deduplicate stores new versions as content-defined chunks.
+	deduplicate bool
+
+	// concurrency is the number of parts of a version to upload or download
+	// at once, in parts of partSize bytes, if the backend supports it.
+	concurrency int
+	partSize    int64
+
+	// uploads persists the state of multipart uploads so they can be
+	// resumed, if set.
+	uploads *UploadStateStore
+
+	// shardBackends store the shards of erasure coded versions, which are
+	// split into dataShards data shards and parityShards parity shards.
+	shardBackends []ShardBackend
+	dataShards    int
+	parityShards  int
+
+	// transformers are applied in order to the contents of new versions.
+	// Any version encoded with transformers in knownTransformers, keyed
+	// by name, can be decoded.
+	transformers      []Transformer
+	knownTransformers map[string]Transformer
+
+	// leaseTTL is how long the lease held by each backup lasts without
+	// being renewed.
+	leaseTTL time.Duration
+}
+
+// Option configures optional behavior of a Manager.
+type Option func(*Manager)
+
+// WithSigningKey configures the Manager to sign each lock it writes with `key`.
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(m *Manager) {
+		m.signingKey = key
+	}
+}
+
+// WithVerifyKey configures the Manager to refuse to use any lock that was not
+// signed by the private key belonging to `key`.
+func WithVerifyKey(key ed25519.PublicKey) Option {
+	return func(m *Manager) {
+		m.verifyKey = key
+	}
+}
+
+// WithDeduplication configures the Manager to split the contents of each
+// backup into content-defined chunks and store each unique chunk only once.
+// Versions stored this way are restored correctly regardless of this option.
+func WithDeduplication() Option {
+	return func(m *Manager) {
+		m.deduplicate = true
+	}
+}
+
+// WithConcurrency configures the Manager to upload and download versions in
+// parts of `partSize` bytes, transferring up to `concurrency` parts at once,
+// for backends which implement MultipartStorer and RangeReader. If
+// `partSize` is 0, DefaultPartSize is used.
+func WithConcurrency(concurrency int, partSize int64) Option {
+	return func(m *Manager) {
+		m.concurrency = concurrency
+		m.partSize = partSize
+	}
+}
+
+// WithResumableUploads configures the Manager to persist the state of each
+// multipart upload in `store`, so that a failed backup can be resumed by
+// backing up the same name from the same source, see WithSource. This
+// only applies to backends which implement MultipartStorer.
+func WithResumableUploads(store UploadStateStore) Option {
+	return func(m *Manager) {
+		m.uploads = &store
+	}
+}
+
+// WithShardBackends configures the backends that shards of erasure coded
+// versions are stored on and restored from. Restoring an erasure coded
+// version requires as many of its shards' backends as it has data shards.
+func WithShardBackends(backends ...ShardBackend) Option {
+	return func(m *Manager) {
+		m.shardBackends = backends
+	}
+}
+
+// WithErasureCoding configures the Manager to store new versions as
+// `dataShards` data shards and `parityShards` parity shards, each on a
+// different one of the first dataShards+parityShards shard backends, so
+// that any `dataShards` of the shards can restore the version. Locks are
+// still stored on the Manager's backend.
+func WithErasureCoding(dataShards, parityShards int) Option {
+	return func(m *Manager) {
+		m.dataShards = dataShards
+		m.parityShards = parityShards
+	}
+}
+
+// WithTransformers configures the Manager to pass the contents of each new
+// version through `transformers` in order before storing them. Restoring a
+// version applies the inverse of the stages it was stored with, regardless
+// of the stages currently configured.
+func WithTransformers(transformers ...Transformer) Option {
+	return func(m *Manager) {
+		m.transformers = transformers
+		for _, transformer := range transformers {
+			m.knownTransformers[transformer.Name()] = transformer
+		}
+	}
+}
+
+// WithKnownTransformers makes `transformers` available for decoding versions
+// without applying them to new versions. Built in transformers, such as
+// GzipTransformer, are always known.
+func WithKnownTransformers(transformers ...Transformer) Option {
+	return func(m *Manager) {
+		for _, transformer := range transformers {
+			m.knownTransformers[transformer.Name()] = transformer
+		}
+	}
 }
 
-// NewManager returns a new Manager with the given backend and versioner.
-func NewManager(backend Backend, versioner Versioner) Manager {
-	return Manager{
+// BackupOption configures a single call to Manager.Backup.
+type BackupOption func(*backupOptions)
+
+type backupOptions struct {
+	skipUnchanged bool
+	parent        string
+	manifest      io.Reader
+	source        string
+	metadata      *FileMetadata
+	labels        Labels
+	message       string
+}
+
+// SkipUnchanged makes Manager.Backup compare the contents to the current
+// version before storing them. If they are identical, no new version is
+// created and the current version is only marked as verified unchanged.
+//
+// Comparing requires reading the contents twice, so unless the reader can
+// seek, the contents are copied to a temporary file in full before they are
+// stored, which needs as much free disk space as the contents take up.
+func SkipUnchanged() BackupOption {
+	return func(o *backupOptions) {
+		o.skipUnchanged = true
+	}
+}
+
+// WithParent records the new version as an increment on top of version
+// `parent`, which must be a version of the same name. Restoring the new
+// version then requires every version in its chain, see Manager.Chain.
+func WithParent(parent string) BackupOption {
+	return func(o *backupOptions) {
+		o.parent = parent
+	}
+}
+
+// WithManifest stores the contents of `reader` alongside the new version as
+// its manifest, which can later be read with Manager.ReadManifest.
+func WithManifest(reader io.Reader) BackupOption {
+	return func(o *backupOptions) {
+		o.manifest = reader
+	}
+}
+
+// WithSource identifies the source of the contents being backed up, such as
+// a file's path, size and modification time. If the Manager is configured
+// with resumable uploads, an unfinished upload of the same name from the
+// same source is resumed instead of starting a new version.
+func WithSource(source string) BackupOption {
+	return func(o *backupOptions) {
+		o.source = source
+	}
+}
+
+// WithMetadata records the metadata of the file being backed up in the new
+// version, see FileMetadata.
+func WithMetadata(metadata FileMetadata) BackupOption {
+	return func(o *backupOptions) {
+		o.metadata = &metadata
+	}
+}
+
+// WithMessage records `message` in the new version, describing why it was
+// backed up. If no new version is created because the contents are
+// unchanged, the message is not recorded.
+func WithMessage(message string) BackupOption {
+	return func(o *backupOptions) {
+		o.message = message
+	}
+}
+
+// VersionExists is an error returned by Manager.Backup when the versioner
+// returns a version that already exists.
+type VersionExists struct {
+	ID string
+}
+
+func (e VersionExists) Error() string {
+	return fmt.Sprintf("version %s already exists", e.ID)
+}
+
+// NewManager returns a new Manager with the given backend and versioner. If
+// `versioner` is nil, a MonotonicVersioner is used.
+func NewManager(backend Backend, versioner Versioner, options ...Option) Manager {
+	if versioner == nil {
+		versioner = NewMonotonicVersioner()
+	}
+
+	m := Manager{
 		backend:   backend,
 		versioner: versioner,
+		knownTransformers: map[string]Transformer{
+			GzipTransformer{}.Name(): GzipTransformer{},
+		},
+	}
+
+	for _, option := range options {
+		option(&m)
 	}
+
+	if m.partSize <= 0 {
+		m.partSize = DefaultPartSize
+	}
+
+	if m.leaseTTL <= 0 {
+		m.leaseTTL = DefaultLeaseTTL
+	}
+
+	return m
 }
 
 // Backup creates and stores a backup for `name` with the contents of `reader`
-// in the Manager's backend. Backups are versioned and stored under a name
-// in the format "$name_$version.bak", where $name is the name passed
-// to this function and $version is calculated from `m.versioner`.
+// in the Manager's backend. Backups are versioned and stored under the key
+// "backups/<name>/versions/<version>", where <name> is the name passed to
+// this function, encoded into a single path segment, and <version> is
+// calculated from `m.versioner`. See KeyNamespace for the full key layout.
 //
-// A lockfile is created for each name and points to the latest stored backup
-// under that name. The lockfile is used to restore from the latest backup.
-func (m Manager) Backup(name string, reader io.Reader) error {
-	currentLock, err := m.getCurrentLock(name)
+// A lock is stored under "backups/<name>/lock" for each name and points to
+// the latest stored backup under that name. The lock is used to restore from
+// the latest backup.
+//
+// Only one backup of a name runs at a time. Each backup holds a Lease on the
+// name while it runs and returns LeaseHeld if another backup holds it. If
+// the backend implements ConditionalStorer, concurrent changes to the lock,
+// such as pins, are also never lost.
+func (m Manager) Backup(name string, reader io.Reader, options ...BackupOption) (err error) {
+	var opts backupOptions
+	for _, option := range options {
+		option(&opts)
+	}
+
+	if err = opts.labels.Validate(); err != nil {
+		return err
+	}
+
+	lease, err := m.acquireLease(name)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if releaseErr := lease.release(); releaseErr != nil && err == nil {
+			err = releaseErr
+		}
+	}()
 
-	backupFilename := fmt.Sprintf("%s_%s.bak", name, m.versioner.GetVersion())
-	if err = m.backend.Store(backupFilename, reader); err != nil {
+	currentLock, err := m.getCurrentLock(name)
+	if err != nil {
 		return err
 	}
 
-	var newLock Lock
-	if currentLock == nil {
-		newLock = NewLock(name, backupFilename, "")
+	if opts.parent != "" {
+		if currentLock == nil {
+			return fmt.Errorf("Parent version %s does not exist", opts.parent)
+		}
+		if _, ok := currentLock.Version(opts.parent); !ok {
+			return fmt.Errorf("Parent version %s does not exist", opts.parent)
+		}
+	}
+
+	if opts.skipUnchanged && currentLock != nil {
+		current, ok := currentLock.Version(currentLock.Current)
+		if ok && current.Checksum != "" {
+			seeker, cleanup, err := spool(reader)
+			defer cleanup()
+			if err != nil {
+				return err
+			}
+
+			checksum, _, err := checksumSeeker(seeker)
+			if err != nil {
+				return err
+			}
+
+			if checksum == current.Checksum {
+				return m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+					// Another writer may have backed up different
+					// contents since the lock was first read.
+					if lock.Current != current.ID {
+						return Lock{}, Conflict{lock.ID()}
+					}
+
+					now := time.Now()
+					current.VerifiedAt = &now
+					current.Labels = current.Labels.merge(opts.labels)
+
+					return lock.Record(current), nil
+				})
+			}
+
+			reader = seeker
+		}
+	}
+
+	var backupFilename string
+	if versioner, ok := m.versioner.(ContentVersioner); ok {
+		// The version depends on the contents, so they are read in full
+		// before they are stored.
+		seeker, cleanup, err := spool(reader)
+		defer cleanup()
+		if err != nil {
+			return err
+		}
+
+		checksum, size, err := checksumSeeker(seeker)
+		if err != nil {
+			return err
+		}
+
+		backupFilename = versionKey(name, versioner.GetContentVersion(ContentInfo{Checksum: checksum, Size: size}))
+		if currentLock != nil {
+			if existing, ok := currentLock.Version(backupFilename); ok && existing.Checksum == checksum {
+				return m.reuseVersion(name, backupFilename, opts.labels)
+			}
+		}
+
+		reader = seeker
 	} else {
-		newLock = currentLock.Shift(backupFilename)
+		backupFilename = versionKey(name, m.versioner.GetVersion())
+	}
+
+	if err = m.checkNewVersion(currentLock, backupFilename); err != nil {
+		return err
+	}
+
+	// The checksum and size are of the contents before they are encoded, so
+	// that they describe what is restored regardless of the encoding.
+	summer := newSummingReader(reader)
+	encoded, transforms, abort, err := m.encode(summer)
+	if err != nil {
+		return err
 	}
 
-	lockBytes, err := json.Marshal(newLock)
+	backupFilename, layout, shards, err := m.storeContents(name, backupFilename, encoded, opts)
 	if err != nil {
+		abort()
 		return err
 	}
-	if err = m.backend.Store(newLock.ID(), bytes.NewReader(lockBytes)); err != nil {
+
+	host, _ := os.Hostname()
+	version := Version{
+		ID:              backupFilename,
+		CreatedAt:       time.Now(),
+		Host:            host,
+		Size:            summer.size,
+		Checksum:        summer.Checksum(),
+		Layout:          layout,
+		Shards:          shards,
+		Transforms:      transforms,
+		Parent:          opts.parent,
+		Metadata:        opts.metadata,
+		Labels:          opts.labels,
+		Message:         opts.message,
+		Author:          author(host),
+		SystoolsVersion: systools.Version,
+	}
+
+	if opts.manifest != nil {
+		version.Manifest = manifestKey(backupFilename)
+		manifestSummer := newSummingReader(opts.manifest)
+		if err = m.backend.Store(version.Manifest, manifestSummer); err != nil {
+			return err
+		}
+		version.ManifestChecksum = manifestSummer.Checksum()
+	}
+
+	if err = lease.Err(); err != nil {
+		return err
+	}
+
+	// The lock is read again, since another writer may have changed it
+	// while the contents were stored.
+	return m.updateLock(name, func(lock *Lock) (Lock, error) {
+		if lock == nil {
+			return NewLock(name, backupFilename, "").Record(version), nil
+		}
+
+		return lock.Shift(backupFilename).Record(version), nil
+	})
+}
+
+// reuseVersion makes existing version `id` of `name` the current version in
+// place of storing a new version with the same contents, marks it as
+// verified unchanged and adds `labels` to it.
+func (m Manager) reuseVersion(name string, id string, labels Labels) error {
+	return m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		version, ok := lock.Version(id)
+		if !ok {
+			return Lock{}, fmt.Errorf("Version %s is missing from lock %s", id, lock.ID())
+		}
+
+		now := time.Now()
+		version.VerifiedAt = &now
+		version.Labels = version.Labels.merge(labels)
+
+		if lock.Current != id {
+			lock = lock.Shift(id)
+		}
+
+		return lock.Record(version), nil
+	})
+}
+
+// checkNewVersion returns VersionExists if version `id` is already recorded in
+// `lock` or stored in the backend, so that it is never overwritten.
+func (m Manager) checkNewVersion(lock *Lock, id string) error {
+	if lock != nil {
+		if _, ok := lock.Version(id); ok {
+			return VersionExists{id}
+		}
+	}
+
+	found, err := exists(m.backend, id)
+	if err != nil {
 		return err
 	}
+	if found {
+		return VersionExists{id}
+	}
 
 	return nil
 }
 
+// storeContents stores the contents of a new version under `id` using the
+// layout the Manager is configured for. It returns the ID the contents were
+// stored under, which differs from `id` when an unfinished upload of the
+// same contents was resumed.
+func (m Manager) storeContents(name string, id string, reader io.Reader, opts backupOptions) (string, string, *ShardLayout, error) {
+	if m.deduplicate && m.dataShards > 0 {
+		return id, "", nil, errors.New("Deduplication and erasure coding cannot be combined")
+	}
+
+	if m.dataShards > 0 {
+		shards, err := m.storeErasure(id, reader)
+		return id, LayoutErasure, shards, err
+	}
+
+	if m.deduplicate {
+		return id, LayoutChunked, nil, m.storeChunked(id, reader)
+	}
+
+	if storer, ok := m.backend.(MultipartStorer); ok && m.uploads != nil && opts.source != "" {
+		state, err := m.resumableUpload(name, opts.source, storer)
+		if err != nil {
+			return id, "", nil, err
+		}
+
+		if state != nil {
+			// Resume the unfinished version rather than starting a new one.
+			id = state.ID
+		} else {
+			state = &UploadState{
+				Name:      name,
+				ID:        id,
+				Source:    opts.source,
+				PartSize:  m.partSize,
+				CreatedAt: time.Now(),
+			}
+		}
+
+		return id, "", nil, m.storeParallel(id, reader, storer, state)
+	}
+
+	return id, "", nil, m.store(id, reader)
+}
+
 // Restore attempts to restore the latest backup under `name` by looking for an
 // associated lock and returning an `io.Reader` for the contents of backup
 // that the lock points to. If no lock exists for the given name, this
 // function is unable to find a back up and will return an error.
+//
+// If the lock has a checksum for the current version, reading the contents
+// to the end returns a ChecksumMismatch error when they do not match it.
 func (m Manager) Restore(name string) (io.Reader, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	version, _ := lock.Version(lock.Current)
+
+	return m.restoreVersion(version)
+}
+
+// RestoreVersion is like Restore, but restores version `id` of `name`
+// instead of the current version. The version may be given by its full ID
+// or by only the version string it was created with, and it must be a
+// version of `name`.
+func (m Manager) RestoreVersion(name string, id string) (io.Reader, error) {
+	version, err := m.Version(name, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return m.restoreVersion(version)
+}
+
+func (m Manager) restoreVersion(version Version) (io.Reader, error) {
+	if version.Parent != "" {
+		return nil, fmt.Errorf("Version %s is incremental and must be restored with its chain", version.ID)
+	}
+
+	return m.ReadVersion(version)
+}
+
+// Rollback points the lock of `name` back to version `id`, so that every
+// following restore of `name` restores that version until the next backup.
+// The version may be given by its full ID or by only the version string it
+// was created with. If `id` is empty, the lock is pointed back to the
+// previous version. The rollback is recorded in the lock, and the version
+// that was current is kept so that the rollback can itself be undone.
+func (m Manager) Rollback(name string, id string) (Version, error) {
+	var version Version
+	err := m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		target := id
+		if target == "" {
+			if lock.Previous == "" {
+				return Lock{}, fmt.Errorf("No previous version of %s exists", name)
+			}
+			target = lock.Previous
+		}
+
+		var err error
+		if version, err = findVersion(lock, target); err != nil {
+			return Lock{}, err
+		}
+
+		host, _ := os.Hostname()
+
+		return lock.RollBack(version.ID, host)
+	})
+
+	return version, err
+}
+
+// Rollbacks returns the records of every rollback of `name`, oldest first.
+func (m Manager) Rollbacks(name string) ([]Rollback, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.Rollbacks, nil
+}
+
+// Versions returns the records of every version of `name`, oldest first.
+func (m Manager) Versions(name string) ([]Version, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.History(), nil
+}
+
+// Version returns the record of version `id` of `name`, which may be given
+// by its full ID or by only the version string it was created with. It
+// returns an error if `id` is not a version of `name`.
+func (m Manager) Version(name string, id string) (Version, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return Version{}, err
+	}
+
+	return findVersion(*lock, id)
+}
+
+// VersionAt returns the record of the newest version of `name` created at or
+// before `at`.
+func (m Manager) VersionAt(name string, at time.Time) (Version, error) {
+	versions, err := m.Versions(name)
+	if err != nil {
+		return Version{}, err
+	}
+
+	var found *Version
+	for i, version := range versions {
+		// Versions recorded without a creation time can't be placed in time.
+		if version.CreatedAt.IsZero() || version.CreatedAt.After(at) {
+			continue
+		}
+		if found == nil || version.CreatedAt.After(found.CreatedAt) {
+			found = &versions[i]
+		}
+	}
+
+	if found == nil {
+		return Version{}, fmt.Errorf("No version of %s exists at or before %s", name, at.Format(time.RFC3339))
+	}
+
+	return *found, nil
+}
+
+// Current returns the record of the current version of `name`, or nil if
+// there is no backup of `name`.
+func (m Manager) Current(name string) (*Version, error) {
+	lock, err := m.getCurrentLock(name)
+	if err != nil || lock == nil {
+		return nil, err
+	}
+
+	version, _ := lock.Version(lock.Current)
+
+	return &version, nil
+}
+
+// Chain returns the records of the versions needed to restore the current
+// version of `name`. The first version holds complete contents and each
+// following version is an increment on top of the one before it.
+func (m Manager) Chain(name string) ([]Version, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.Chain(lock.Current)
+}
+
+// VersionChain is like Chain, but returns the versions needed to restore
+// version `id` of `name` instead of the current version.
+func (m Manager) VersionChain(name string, id string) ([]Version, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := findVersion(*lock, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.Chain(version.ID)
+}
+
+// ReadManifest returns a reader for the manifest stored alongside `version`.
+func (m Manager) ReadManifest(version Version) (io.Reader, error) {
+	if version.Manifest == "" {
+		return nil, fmt.Errorf("Version %s has no manifest", version.ID)
+	}
+
+	reader, err := m.backend.Read(version.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return newVerifyingReader(reader, version.Manifest, version.ManifestChecksum), nil
+}
+
+// ReadVersion returns a reader for the contents of `version`, reassembling
+// them according to the version's layout. If the reader of the stored
+// contents can be closed, such as one downloading them ahead of being read,
+// the returned reader implements io.Closer too, which must be called if it
+// is not read to its end.
+func (m Manager) ReadVersion(version Version) (io.Reader, error) {
+	var reader io.Reader
+	var err error
+
+	switch version.Layout {
+	case "":
+		reader, err = m.read(version.ID)
+	case LayoutChunked:
+		reader, err = m.readChunked(version.ID)
+	case LayoutErasure:
+		reader, err = m.readErasure(version)
+	default:
+		err = fmt.Errorf("Version %s has unknown layout %q", version.ID, version.Layout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	closer, closes := reader.(io.Closer)
+	if reader, err = m.decode(reader, version.Transforms); err != nil {
+		if closes {
+			closer.Close()
+		}
+		return nil, err
+	}
+
+	if version.Checksum != "" {
+		reader = newVerifyingReader(reader, version.ID, version.Checksum)
+	}
+
+	if closes {
+		return struct {
+			io.Reader
+			io.Closer
+		}{reader, closer}, nil
+	}
+
+	return reader, nil
+}
+
+// ReadVerifiedVersion is like ReadVersion, but reads the contents in full into
+// a temporary file before returning them, so that they are verified before
+// any of them are used. Readers that may stop before the end of the
+// contents, such as tar readers, never see a checksum mismatch otherwise.
+// This needs as much free space in the temporary directory as the version's
+// contents take. The returned function removes the temporary file and must
+// always be called.
+func (m Manager) ReadVerifiedVersion(version Version) (io.ReadSeeker, func(), error) {
+	reader, err := m.ReadVersion(version)
+	if err != nil {
+		return nil, func() {}, err
+	}
+
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	// Hide any Seek method, so that the contents are always read in full.
+	return spool(struct{ io.Reader }{reader})
+}
+
+// store stores the contents of `reader` under `id`, in concurrent parts if
+// the Manager and its backend support it.
+func (m Manager) store(id string, reader io.Reader) error {
+	if storer, ok := m.backend.(MultipartStorer); ok && m.concurrency > 1 {
+		return m.storeParallel(id, reader, storer, nil)
+	}
+
+	return m.backend.Store(id, reader)
+}
+
+// read returns a reader for the contents stored under `id`, which downloads
+// them in concurrent ranges if the Manager and its backend support it.
+func (m Manager) read(id string) (io.Reader, error) {
+	if rangeReader, ok := m.backend.(RangeReader); ok && m.concurrency > 1 {
+		size, err := rangeReader.Size(id)
+		if err != nil {
+			return nil, err
+		}
+
+		return newParallelReader(rangeReader, id, size, m.partSize, m.concurrency), nil
+	}
+
+	return m.backend.Read(id)
+}
+
+// getExistingLock is like getCurrentLock, but returns an error if no backup of
+// `name` exists.
+func (m Manager) getExistingLock(name string) (*Lock, error) {
 	lock, err := m.getCurrentLock(name)
 	if err != nil {
 		return nil, err
@@ -72,27 +806,164 @@ func (m Manager) Restore(name string) (io.Reader, error) {
 		return nil, fmt.Errorf("No backup exists for file %s", name)
 	}
 
-	return m.backend.Read(lock.Current)
+	return lock, nil
 }
 
 func (m Manager) getCurrentLock(name string) (*Lock, error) {
-	lockReader, err := m.backend.Read(fmt.Sprintf("%s.lock", name))
+	lock, _, err := m.readLock(name)
+	if lock != nil {
+		upgraded := lock.Upgrade()
+		lock = &upgraded
+	}
+
+	return lock, err
+}
+
+// readLock reads the lock of `name` as it is stored, without upgrading it,
+// along with its tag, which is empty if the backend does not implement
+// ConditionalStorer or if there is no lock. If there is no lock under its
+// key, the lock is read from the legacy key layout, without a tag, so that
+// storing it moves it to its key, see KeyNamespace. A lock that can't be
+// decoded is returned as CorruptLock along with its tag, so that it can be
+// replaced.
+func (m Manager) readLock(name string) (*Lock, string, error) {
+	lock, tag, err := m.readLockAt(name, lockKey(name))
+	if lock != nil || err != nil {
+		return lock, tag, err
+	}
+
+	lock, _, err = m.readLockAt(name, legacyLockKey(name))
+
+	return lock, "", err
+}
+
+// readLockAt reads the lock of `name` stored under `key`, see readLock.
+func (m Manager) readLockAt(name string, key string) (*Lock, string, error) {
+	lockReader, tag, err := readTagged(m.backend, key)
 	if err != nil {
 		// If the we get an error because the lock does not exist, we'll simply
 		// return a nil lock with no error. The caller must determine if it
 		// is ok for a lock not to exist for the given name.
 		if _, ok := err.(NoSuchName); ok {
-			return nil, nil
+			return nil, "", nil
 		}
-		return nil, err
+		return nil, "", err
 	}
 
 	lockBytes, err := ioutil.ReadAll(lockReader)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
 	lock, err := NewLockFromBytes(lockBytes)
+	if err != nil {
+		return nil, tag, CorruptLock{key, err}
+	}
+
+	if lock.Format > LockFormat {
+		return nil, "", UnsupportedFormat{key, lock.Format}
+	}
+
+	if m.verifyKey != nil {
+		if err = lock.Verify(m.verifyKey); err != nil {
+			return nil, "", err
+		}
+
+		// The signature only vouches for the lock of the name it records,
+		// so a validly signed lock copied to another name is rejected.
+		if lock.Name != name {
+			return nil, "", InvalidSignature{key}
+		}
+	}
+
+	return &lock, tag, nil
+}
+
+// updateLock reads the lock of `name`, which is nil if there is none, and
+// stores the lock returned by `update`. If the backend implements
+// ConditionalStorer, the lock is only stored if no other writer changed it
+// in the meantime. Otherwise, `update` is applied again to the changed lock,
+// up to lockAttempts times before giving up with a Conflict error.
+func (m Manager) updateLock(name string, update func(lock *Lock) (Lock, error)) error {
+	for attempt := 1; ; attempt++ {
+		lock, tag, err := m.readLock(name)
+		if err != nil {
+			return err
+		}
+
+		if lock != nil {
+			upgraded := lock.Upgrade()
+			lock = &upgraded
+		}
+
+		updated, err := update(lock)
+		if err != nil {
+			return err
+		}
+
+		err = m.storeLock(updated, tag)
+		if _, ok := err.(Conflict); !ok || attempt == lockAttempts {
+			return err
+		}
+
+		// Back off for a random time, so that writers retrying at once
+		// don't keep conflicting with each other.
+		time.Sleep(time.Duration(attempt) * time.Duration(rand.Int63n(int64(lockRetryDelay))))
+	}
+}
+
+// updateExistingLock is like updateLock, but returns an error if no backup of
+// `name` exists.
+func (m Manager) updateExistingLock(name string, update func(lock Lock) (Lock, error)) error {
+	return m.updateLock(name, func(lock *Lock) (Lock, error) {
+		if lock == nil {
+			return Lock{}, fmt.Errorf("No backup exists for file %s", name)
+		}
+
+		return update(*lock)
+	})
+}
+
+// findVersion returns the record of version `id` of `lock`, which may be the
+// version's full ID or only the version string it was created with.
+func findVersion(lock Lock, id string) (Version, error) {
+	for _, candidate := range []string{id, versionKey(lock.Name, id), legacyVersionKey(lock.Name, id)} {
+		if version, ok := lock.Version(candidate); ok {
+			return version, nil
+		}
+	}
+
+	return Version{}, fmt.Errorf("%s is not a version of %s", id, lock.Name)
+}
+
+// storeLock signs and stores `lock`. If the backend implements
+// ConditionalStorer, it is only stored if the stored lock still has `tag`,
+// or if there is no stored lock when `tag` is empty.
+func (m Manager) storeLock(lock Lock, tag string) error {
+	lock.Format = LockFormat
+
+	var err error
+	if m.signingKey != nil {
+		if lock, err = lock.Sign(m.signingKey); err != nil {
+			return err
+		}
+	}
+
+	lockBytes, err := json.Marshal(lock)
+	if err != nil {
+		return err
+	}
+
+	return storeIf(m.backend, lock.ID(), bytes.NewReader(lockBytes), tag)
+}
+
+// author returns the name of the current user at `host`, in the format
+// "user@host".
+func author(host string) string {
+	username := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
 
-	return &lock, err
+	return fmt.Sprintf("%s@%s", username, host)
 }
@@ -1,10 +1,26 @@
 package backups
 
 import (
+	"archive/tar"
 	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	systools "github.com/samrap/systools/pkg/version"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -17,8 +33,8 @@ func Test_ItBacksUpBytesAtTheGivenName(t *testing.T) {
 	err := manager.Backup("truth.txt", bytes.NewReader(contents))
 
 	assert.NoError(t, err)
-	assert.Contains(t, backend.Backups, "truth.txt_VERSION.bak")
-	assert.Equal(t, contents, backend.Backups["truth.txt_VERSION.bak"])
+	assert.Contains(t, backend.Backups, versionKey("truth.txt", "VERSION"))
+	assert.Equal(t, contents, backend.Backups[versionKey("truth.txt", "VERSION")])
 }
 
 func Test_ItCreatesALockForBackup(t *testing.T) {
@@ -30,7 +46,7 @@ func Test_ItCreatesALockForBackup(t *testing.T) {
 	err := manager.Backup("truth.txt", bytes.NewReader(contents))
 
 	assert.NoError(t, err)
-	assert.Contains(t, backend.Backups, "truth.txt.lock")
+	assert.Contains(t, backend.Backups, lockKey("truth.txt"))
 }
 
 func TestLockForNewBackup(t *testing.T) {
@@ -43,11 +59,11 @@ func TestLockForNewBackup(t *testing.T) {
 
 	assert.NoError(t, err)
 
-	lock, err := NewLockFromBytes(backend.Backups["truth.txt.lock"])
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("truth.txt")])
 
 	assert.NoError(t, err)
 	assert.Equal(t, "truth.txt", lock.Name)
-	assert.Equal(t, "truth.txt_VERSION.bak", lock.Current)
+	assert.Equal(t, versionKey("truth.txt", "VERSION"), lock.Current)
 	assert.Equal(t, "", lock.Previous)
 }
 
@@ -61,16 +77,22 @@ func TestLockForExistingBackup(t *testing.T) {
 	// Perform two backups.
 	err := manager.Backup("truth.txt", bytes.NewReader(contents))
 	assert.NoError(t, err)
+	manager.versioner = newStaticVersioner("VERSION_2")
 	err = manager.Backup("truth.txt", bytes.NewReader(contents))
 	assert.NoError(t, err)
 
-	lock, err := NewLockFromBytes(backend.Backups["truth.txt.lock"])
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("truth.txt")])
 
 	assert.NoError(t, err)
 	assert.Equal(t, "truth.txt", lock.Name)
 	// There should be current and previous versions in the lock.
-	assert.Equal(t, "truth.txt_VERSION.bak", lock.Current)
-	assert.Equal(t, "truth.txt_VERSION.bak", lock.Previous)
+	assert.Equal(t, versionKey("truth.txt", "VERSION_2"), lock.Current)
+	assert.Equal(t, versionKey("truth.txt", "VERSION"), lock.Previous)
+
+	// An existing version is never overwritten.
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("Everything is certain.")))
+	assert.Equal(t, VersionExists{versionKey("truth.txt", "VERSION_2")}, err)
+	assert.Equal(t, contents, backend.Backups[versionKey("truth.txt", "VERSION_2")])
 }
 
 func Test_ItRestoresFromTheGivenName(t *testing.T) {
@@ -124,3 +146,1432 @@ func Test_ItAlwaysRestoresTheCurrentVersion(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, v2Contents, bytes)
 }
+
+func Test_ItDetectsTamperedBackupContents(t *testing.T) {
+	versioner := newStaticVersioner("VERSION")
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, versioner)
+
+	err := manager.Backup("truth.txt", bytes.NewReader([]byte("Nothing is certain but death and taxes.")))
+	assert.NoError(t, err)
+
+	backend.Backups[versionKey("truth.txt", "VERSION")] = []byte("Everything is certain.")
+
+	reader, err := manager.Restore("truth.txt")
+	assert.NoError(t, err)
+
+	_, err = ioutil.ReadAll(reader)
+	assert.Equal(t, ChecksumMismatch{versionKey("truth.txt", "VERSION")}, err)
+}
+
+func Test_ItVerifiesSignedLocks(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithSigningKey(privateKey), WithVerifyKey(publicKey))
+
+	contents := []byte("Nothing is certain but death and taxes.")
+	err = manager.Backup("truth.txt", bytes.NewReader(contents))
+	assert.NoError(t, err)
+
+	reader, err := manager.Restore("truth.txt")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, restored)
+}
+
+func Test_ItRejectsTamperedLocks(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	backend := NewInMemoryBackend()
+	signer := NewManager(backend, newStaticVersioner("VERSION"), WithSigningKey(privateKey))
+	verifier := NewManager(backend, newStaticVersioner("VERSION"), WithVerifyKey(publicKey))
+
+	err = signer.Backup("truth.txt", bytes.NewReader([]byte("Nothing is certain but death and taxes.")))
+	assert.NoError(t, err)
+
+	// Rewrite both the backup and its lock as an attacker with access to the
+	// backend would, recomputing the checksum of the new contents.
+	tampered := []byte("Everything is certain.")
+	backend.Backups[versionKey("truth.txt", "VERSION")] = tampered
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("truth.txt")])
+	assert.NoError(t, err)
+	sum := sha256.Sum256(tampered)
+	lock = lock.Record(Version{ID: lock.Current, Size: int64(len(tampered)), Checksum: hex.EncodeToString(sum[:])})
+	backend.Backups[lockKey("truth.txt")], _ = json.Marshal(lock)
+
+	_, err = verifier.Restore("truth.txt")
+	assert.Equal(t, InvalidSignature{lockKey("truth.txt")}, err)
+
+	// An unsigned lock must not be accepted either.
+	unsigned := NewManager(backend, newStaticVersioner("VERSION_2"))
+	err = unsigned.Backup("truth.txt", bytes.NewReader(tampered))
+	assert.NoError(t, err)
+
+	_, err = verifier.Restore("truth.txt")
+	assert.Equal(t, InvalidSignature{lockKey("truth.txt")}, err)
+}
+
+func Test_ItRejectsSignedLocksOfOtherNames(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithSigningKey(privateKey), WithVerifyKey(publicKey))
+
+	err = manager.Backup("/etc/shadow", bytes.NewReader([]byte("root:secret")))
+	assert.NoError(t, err)
+	err = manager.Backup("/etc/hosts", bytes.NewReader([]byte("127.0.0.1 localhost")))
+	assert.NoError(t, err)
+
+	// Swap the validly signed locks of the two names.
+	shadow, hosts := backend.Backups[lockKey("/etc/shadow")], backend.Backups[lockKey("/etc/hosts")]
+	backend.Backups[lockKey("/etc/hosts")], backend.Backups[lockKey("/etc/shadow")] = shadow, hosts
+
+	_, err = manager.Restore("/etc/hosts")
+	assert.Equal(t, InvalidSignature{lockKey("/etc/hosts")}, err)
+
+	_, err = manager.Restore("/etc/shadow")
+	assert.Equal(t, InvalidSignature{lockKey("/etc/shadow")}, err)
+}
+
+func Test_ItDeduplicatesChunksAcrossVersions(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithDeduplication())
+
+	v1Contents := make([]byte, 8*1024*1024)
+	rand.New(rand.NewSource(1)).Read(v1Contents)
+
+	err := manager.Backup("www.tar", bytes.NewReader(v1Contents))
+	assert.NoError(t, err)
+	v1Objects := len(backend.Backups)
+
+	// Insert a few bytes in the middle, which should only change the chunks
+	// around the insertion.
+	v2Contents := append([]byte{}, v1Contents[:3*1024*1024]...)
+	v2Contents = append(v2Contents, []byte("a small change")...)
+	v2Contents = append(v2Contents, v1Contents[3*1024*1024:]...)
+
+	manager.versioner = newStaticVersioner("VERSION_2")
+	err = manager.Backup("www.tar", bytes.NewReader(v2Contents))
+	assert.NoError(t, err)
+	assert.True(t, len(backend.Backups)-v1Objects <= 3, "expected at most 2 new chunks and 1 new index")
+
+	reader, err := manager.Restore("www.tar")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, v2Contents, restored)
+}
+
+func Test_ItSkipsUnchangedContents(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	contents := []byte("127.0.0.1 localhost")
+	err := manager.Backup("hosts", bytes.NewReader(contents))
+	assert.NoError(t, err)
+
+	manager.versioner = newStaticVersioner("VERSION_2")
+	err = manager.Backup("hosts", ioutil.NopCloser(bytes.NewReader(contents)), SkipUnchanged())
+	assert.NoError(t, err)
+
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("hosts")])
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("hosts", "VERSION"), lock.Current)
+	assert.NotContains(t, backend.Backups, versionKey("hosts", "VERSION_2"))
+
+	version, _ := lock.Version(lock.Current)
+	assert.NotNil(t, version.VerifiedAt)
+
+	// Changed contents are still backed up as a new version.
+	err = manager.Backup("hosts", bytes.NewReader([]byte("127.0.0.1 example.com")), SkipUnchanged())
+	assert.NoError(t, err)
+
+	lock, err = NewLockFromBytes(backend.Backups[lockKey("hosts")])
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("hosts", "VERSION_2"), lock.Current)
+	assert.Equal(t, versionKey("hosts", "VERSION"), lock.Previous)
+}
+
+func Test_ItKeepsTheChainOfIncrementalVersions(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("FULL"))
+
+	err := manager.Backup("www", bytes.NewReader([]byte("full")), WithManifest(bytes.NewReader([]byte("{}"))))
+	assert.NoError(t, err)
+
+	for _, version := range []string{"INC_1", "INC_2", "INC_3"} {
+		current, err := manager.Current("www")
+		assert.NoError(t, err)
+
+		manager.versioner = newStaticVersioner(version)
+		err = manager.Backup("www", bytes.NewReader([]byte(version)), WithParent(current.ID))
+		assert.NoError(t, err)
+	}
+
+	chain, err := manager.Chain("www")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, len(chain))
+	assert.Equal(t, versionKey("www", "FULL"), chain[0].ID)
+	assert.Equal(t, versionKey("www", "INC_3"), chain[3].ID)
+
+	reader, err := manager.ReadManifest(chain[0])
+	assert.NoError(t, err)
+	manifest, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("{}"), manifest)
+
+	_, err = manager.Restore("www")
+	assert.Error(t, err)
+
+	err = manager.Backup("www", bytes.NewReader([]byte("orphan")), WithParent(versionKey("www", "MISSING")))
+	assert.Error(t, err)
+}
+
+func Test_ItTransfersVersionsInParallelParts(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithConcurrency(4, 1024))
+
+	contents := make([]byte, 10*1024+17)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	err := manager.Backup("dump.sql", bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.Equal(t, contents, backend.Backups[versionKey("dump.sql", "VERSION")])
+	assert.Empty(t, backend.uploads)
+
+	reader, err := manager.Restore("dump.sql")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, restored)
+}
+
+// flakyBackend fails to store parts once a number of parts have been stored.
+type flakyBackend struct {
+	*InMemoryBackend
+	failAfter int
+	stored    int
+}
+
+func (b *flakyBackend) StorePart(name string, uploadID string, number int, reader io.ReadSeeker) (string, error) {
+	b.InMemoryBackend.mu.Lock()
+	b.stored++
+	failed := b.failAfter >= 0 && b.stored > b.failAfter
+	b.InMemoryBackend.mu.Unlock()
+
+	if failed {
+		return "", errors.New("connection reset")
+	}
+
+	return b.InMemoryBackend.StorePart(name, uploadID, number, reader)
+}
+
+func Test_ItResumesUnfinishedUploads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systools-uploads")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewUploadStateStore(dir)
+	backend := &flakyBackend{InMemoryBackend: NewInMemoryBackend(), failAfter: 3}
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithConcurrency(1, 1024), WithResumableUploads(store))
+
+	contents := make([]byte, 10*1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	err = manager.Backup("dump.sql", bytes.NewReader(contents), WithSource("dump.sql:10240"))
+	assert.Error(t, err)
+	assert.NotContains(t, backend.Backups, lockKey("dump.sql"))
+
+	state, err := store.Load("dump.sql")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(state.Parts))
+
+	// The retry must resume the same version and only upload the rest.
+	backend.failAfter = -1
+	backend.stored = 0
+	manager.versioner = newStaticVersioner("VERSION_2")
+	err = manager.Backup("dump.sql", bytes.NewReader(contents), WithSource("dump.sql:10240"))
+	assert.NoError(t, err)
+	assert.Equal(t, 7, backend.stored)
+	assert.Equal(t, contents, backend.Backups[versionKey("dump.sql", "VERSION")])
+
+	state, err = store.Load("dump.sql")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func Test_ItAbortsUnfinishedUploadsFromAnotherSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "systools-uploads")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewUploadStateStore(dir)
+	backend := &flakyBackend{InMemoryBackend: NewInMemoryBackend(), failAfter: 3}
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithConcurrency(1, 1024), WithResumableUploads(store))
+
+	contents := make([]byte, 10*1024)
+	err = manager.Backup("dump.sql", bytes.NewReader(contents), WithSource("dump.sql:old"))
+	assert.Error(t, err)
+
+	backend.failAfter = -1
+	manager.versioner = newStaticVersioner("VERSION_2")
+	err = manager.Backup("dump.sql", bytes.NewReader(contents), WithSource("dump.sql:new"))
+	assert.NoError(t, err)
+	assert.Contains(t, backend.Backups, versionKey("dump.sql", "VERSION_2"))
+	assert.Empty(t, backend.uploads)
+}
+
+func Test_ItReconstructsErasureCodedVersionsFromAvailableShards(t *testing.T) {
+	var shardBackends []ShardBackend
+	var memoryBackends []*InMemoryBackend
+	for _, name := range []string{"aws", "do", "gcs", "b2", "wasabi"} {
+		backend := NewInMemoryBackend()
+		memoryBackends = append(memoryBackends, backend)
+		shardBackends = append(shardBackends, ShardBackend{Name: name, Backend: backend})
+	}
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithShardBackends(shardBackends...), WithErasureCoding(3, 2))
+
+	contents := make([]byte, 7*1024*1024+3)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	err := manager.Backup("dump.sql", bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.NotContains(t, backend.Backups, versionKey("dump.sql", "VERSION"))
+	assert.Contains(t, memoryBackends[4].Backups, versionKey("dump.sql", "VERSION")+".shard4")
+
+	// Lose two of the data shards' backends.
+	memoryBackends[0].Backups = make(map[string][]byte)
+	memoryBackends[2].Backups = make(map[string][]byte)
+
+	reader, err := manager.Restore("dump.sql")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, restored)
+
+	// With a third backend gone the version can't be restored.
+	memoryBackends[3].Backups = make(map[string][]byte)
+
+	_, err = manager.Restore("dump.sql")
+	assert.Error(t, err)
+}
+
+// reverseTransformer reverses the bytes of its contents.
+type reverseTransformer struct{}
+
+func (t reverseTransformer) Name() string {
+	return "reverse"
+}
+
+func (t reverseTransformer) Encode(reader io.Reader) (io.Reader, error) {
+	contents, err := ioutil.ReadAll(reader)
+	for i, j := 0, len(contents)-1; i < j; i, j = i+1, j-1 {
+		contents[i], contents[j] = contents[j], contents[i]
+	}
+
+	return bytes.NewReader(contents), err
+}
+
+func (t reverseTransformer) Decode(reader io.Reader) (io.Reader, error) {
+	return t.Encode(reader)
+}
+
+func Test_ItDecodesVersionsWithTheStagesTheyWereEncodedWith(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithTransformers(reverseTransformer{}, GzipTransformer{}))
+
+	contents := bytes.Repeat([]byte("Nothing is certain but death and taxes. "), 100)
+	err := manager.Backup("truth.txt", bytes.NewReader(contents))
+	assert.NoError(t, err)
+	assert.True(t, len(backend.Backups[versionKey("truth.txt", "VERSION")]) < len(contents))
+
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("truth.txt")])
+	assert.NoError(t, err)
+	version, _ := lock.Version(lock.Current)
+	assert.Equal(t, []string{"reverse", "gzip"}, version.Transforms)
+
+	// A Manager with different defaults can still restore the version as
+	// long as it knows of its stages.
+	restorer := NewManager(backend, newStaticVersioner("VERSION"), WithKnownTransformers(reverseTransformer{}))
+	reader, err := restorer.Restore("truth.txt")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, restored)
+
+	_, err = NewManager(backend, newStaticVersioner("VERSION")).Restore("truth.txt")
+	assert.Equal(t, UnknownTransformer{"reverse"}, err)
+}
+
+// backupVersions backs up each of `versions` of `name` in turn, with the
+// version as its contents.
+func backupVersions(t *testing.T, manager *Manager, name string, versions ...string) {
+	t.Helper()
+
+	for _, version := range versions {
+		manager.versioner = newStaticVersioner(version)
+		err := manager.Backup(name, bytes.NewReader([]byte(version)))
+		assert.NoError(t, err)
+	}
+}
+
+func Test_ItKeepsARecordOfEveryVersion(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backupVersions(t, &manager, "truth.txt", "V1", "V2", "V3")
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(versions))
+
+	hostname, _ := os.Hostname()
+	for i, id := range []string{versionKey("truth.txt", "V1"), versionKey("truth.txt", "V2"), versionKey("truth.txt", "V3")} {
+		assert.Equal(t, id, versions[i].ID)
+		assert.Equal(t, int64(2), versions[i].Size)
+		assert.Equal(t, hostname, versions[i].Host)
+	}
+}
+
+func Test_ItKeepsVersionsOfLocksWithoutRecords(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V3"))
+
+	// A lock as written before versions were recorded.
+	backend.Backups["truth.txt.lock"] = []byte(`{"name":"truth.txt","current":"truth.txt_V2.bak","previous":"truth.txt_V1.bak"}`)
+
+	err := manager.Backup("truth.txt", bytes.NewReader([]byte("V3")))
+	assert.NoError(t, err)
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(versions))
+	assert.Equal(t, "truth.txt_V1.bak", versions[0].ID)
+	assert.Equal(t, "truth.txt_V2.bak", versions[1].ID)
+	assert.Equal(t, versionKey("truth.txt", "V3"), versions[2].ID)
+
+	// The lock is moved to its key when it is written.
+	assert.Contains(t, backend.Backups, lockKey("truth.txt"))
+}
+
+func Test_ItRestoresASpecificVersion(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backupVersions(t, &manager, "truth.txt", "V1", "V2", "V3")
+
+	for _, id := range []string{"V1", versionKey("truth.txt", "V1")} {
+		reader, err := manager.RestoreVersion("truth.txt", id)
+		assert.NoError(t, err)
+
+		restored, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("V1"), restored)
+	}
+
+	// Versions of other names must not be restorable through this name.
+	err := manager.Backup("secrets.txt", bytes.NewReader([]byte("hunter2")))
+	assert.NoError(t, err)
+
+	_, err = manager.RestoreVersion("truth.txt", versionKey("secrets.txt", "V3"))
+	assert.Error(t, err)
+}
+
+func Test_ItFindsTheVersionAtAPointInTime(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backupVersions(t, &manager, "truth.txt", "V1", "V2", "V3")
+
+	// Space the versions a day apart.
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("truth.txt")])
+	assert.NoError(t, err)
+	start := time.Date(2026, 10, 1, 3, 0, 0, 0, time.UTC)
+	for i := range lock.Versions {
+		lock.Versions[i].CreatedAt = start.AddDate(0, 0, i)
+	}
+	backend.Backups[lockKey("truth.txt")], _ = json.Marshal(lock)
+
+	version, err := manager.VersionAt("truth.txt", start.Add(36*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("truth.txt", "V2"), version.ID)
+
+	version, err = manager.VersionAt("truth.txt", start)
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("truth.txt", "V1"), version.ID)
+
+	_, err = manager.VersionAt("truth.txt", start.Add(-time.Second))
+	assert.Error(t, err)
+}
+
+func Test_ItRollsBackToAnOlderVersion(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backupVersions(t, &manager, "truth.txt", "V1", "V2", "V3")
+
+	version, err := manager.Rollback("truth.txt", "V1")
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("truth.txt", "V1"), version.ID)
+
+	reader, err := manager.Restore("truth.txt")
+	assert.NoError(t, err)
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("V1"), restored)
+
+	// Rolling back without a version undoes the rollback.
+	version, err = manager.Rollback("truth.txt", "")
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("truth.txt", "V3"), version.ID)
+
+	_, err = manager.Rollback("truth.txt", "V3")
+	assert.Error(t, err)
+
+	// Rollbacks are kept by later backups.
+	manager.versioner = newStaticVersioner("V4")
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("V4")))
+	assert.NoError(t, err)
+
+	rollbacks, err := manager.Rollbacks("truth.txt")
+	assert.NoError(t, err)
+	assert.Len(t, rollbacks, 2)
+	assert.Equal(t, versionKey("truth.txt", "V3"), rollbacks[0].From)
+	assert.Equal(t, versionKey("truth.txt", "V1"), rollbacks[0].To)
+	assert.Equal(t, versionKey("truth.txt", "V1"), rollbacks[1].From)
+	assert.Equal(t, versionKey("truth.txt", "V3"), rollbacks[1].To)
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 4)
+}
+
+func Test_ItNeverDeletesPinnedVersions(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backupVersions(t, &manager, "truth.txt", "V1", "V2", "V3")
+
+	_, err := manager.Pin("truth.txt", "V1", "")
+	assert.Error(t, err)
+
+	version, err := manager.Pin("truth.txt", "V1", "before the migration")
+	assert.NoError(t, err)
+	assert.Equal(t, "before the migration", version.Pin.Reason)
+
+	_, err = manager.DeleteVersion("truth.txt", "V1")
+	assert.IsType(t, VersionPinned{}, err)
+	assert.Contains(t, backend.Backups, versionKey("truth.txt", "V1"))
+
+	// The current version can't be deleted either.
+	_, err = manager.DeleteVersion("truth.txt", "V3")
+	assert.Error(t, err)
+
+	_, err = manager.DeleteVersion("truth.txt", "V2")
+	assert.NoError(t, err)
+	assert.NotContains(t, backend.Backups, versionKey("truth.txt", "V2"))
+
+	_, err = manager.Unpin("truth.txt", "V1")
+	assert.NoError(t, err)
+
+	_, err = manager.DeleteVersion("truth.txt", "V1")
+	assert.NoError(t, err)
+	assert.NotContains(t, backend.Backups, versionKey("truth.txt", "V1"))
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, versionKey("truth.txt", "V3"), versions[0].ID)
+}
+
+func Test_ItKeepsVersionsByRetentionPolicy(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	lock := NewLock("truth.txt", "V6", "V5")
+	for i, created := range []time.Time{
+		now.AddDate(-1, 0, 0),
+		now.AddDate(0, -1, 0),
+		now.Add(-50 * time.Hour),
+		now.Add(-49 * time.Hour),
+		now.Add(-3 * time.Hour),
+		now.Add(-1 * time.Hour),
+	} {
+		lock = lock.Record(Version{ID: fmt.Sprintf("V%d", i+1), CreatedAt: created})
+	}
+	pinned, _ := lock.Version("V1")
+	pinned.Pin = &Pin{Reason: "migration"}
+	lock = lock.Record(pinned)
+
+	policy := RetentionPolicy{KeepLast: 1, KeepDaily: 2}
+	kept := make(map[string][]string)
+	for _, decision := range policy.Apply(lock, now) {
+		if decision.Keep {
+			kept[decision.Version.ID] = decision.Reasons
+		}
+	}
+
+	assert.Equal(t, map[string][]string{
+		"V6": {"current version", "last 1", "daily 2026-10-18"},
+		"V4": {"daily 2026-10-16"},
+		"V1": {"pinned: migration"},
+	}, kept)
+
+	// Keeping an incremental version keeps the versions it is built on.
+	increment, _ := lock.Version("V4")
+	increment.Parent = "V3"
+	lock = lock.Record(increment)
+
+	kept = make(map[string][]string)
+	for _, decision := range policy.Apply(lock, now) {
+		if decision.Keep {
+			kept[decision.Version.ID] = decision.Reasons
+		}
+	}
+	assert.Equal(t, []string{"parent of V4"}, kept["V3"])
+}
+
+func Test_ItPrunesVersionsNotKeptByTheRetentionPolicy(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backupVersions(t, &manager, "truth.txt", "V1", "V2", "V3")
+
+	_, err := manager.Prune("truth.txt", false)
+	assert.Error(t, err)
+
+	assert.Error(t, manager.SetRetention("truth.txt", &RetentionPolicy{}))
+	assert.NoError(t, manager.SetRetention("truth.txt", &RetentionPolicy{KeepLast: 2}))
+
+	decisions, err := manager.Prune("truth.txt", true)
+	assert.NoError(t, err)
+	assert.Len(t, decisions, 3)
+	assert.False(t, decisions[2].Keep)
+	assert.Contains(t, backend.Backups, versionKey("truth.txt", "V1"))
+
+	_, err = manager.Prune("truth.txt", false)
+	assert.NoError(t, err)
+	assert.NotContains(t, backend.Backups, versionKey("truth.txt", "V1"))
+
+	// The policy is kept by later backups.
+	manager.versioner = newStaticVersioner("V4")
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("V4")))
+	assert.NoError(t, err)
+
+	_, err = manager.Prune("truth.txt", false)
+	assert.NoError(t, err)
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, versionKey("truth.txt", "V3"), versions[0].ID)
+	assert.Equal(t, versionKey("truth.txt", "V4"), versions[1].ID)
+}
+
+func Test_ItCollectsOrphanedObjects(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V1"), WithDeduplication())
+
+	err := manager.Backup("truth.txt", bytes.NewReader([]byte("V1")))
+	assert.NoError(t, err)
+
+	manager.versioner = newStaticVersioner("V2")
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("V2")))
+	assert.NoError(t, err)
+
+	// A backup that failed before storing its lock leaves orphans behind.
+	assert.NoError(t, backend.Store(versionKey("truth.txt", "V3"), bytes.NewReader([]byte("{}"))))
+	assert.NoError(t, backend.Store("chunks/orphan", bytes.NewReader([]byte("V3"))))
+	backend.Modified[versionKey("truth.txt", "V3")] = time.Now().Add(-2 * time.Hour)
+	objects := len(backend.Backups)
+
+	orphans, err := manager.GC(time.Hour, true)
+	assert.NoError(t, err)
+	assert.Len(t, orphans, 1)
+	assert.Equal(t, versionKey("truth.txt", "V3"), orphans[0].Name)
+	assert.Len(t, backend.Backups, objects)
+
+	orphans, err = manager.GC(0, false)
+	assert.NoError(t, err)
+	assert.Len(t, orphans, 2)
+	assert.Len(t, backend.Backups, objects-2)
+	assert.NotContains(t, backend.Backups, versionKey("truth.txt", "V3"))
+	assert.NotContains(t, backend.Backups, "chunks/orphan")
+
+	for _, version := range []string{"V1", "V2"} {
+		reader, err := manager.RestoreVersion("truth.txt", version)
+		assert.NoError(t, err)
+
+		restored, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(version), restored)
+	}
+}
+
+// interleavingBackend calls `during` the first time the existence of a name
+// matching `prefix` is checked, before answering.
+type interleavingBackend struct {
+	*InMemoryBackend
+	prefix string
+	during func()
+	once   *sync.Once
+}
+
+func (b interleavingBackend) Exists(name string) (bool, error) {
+	if strings.HasPrefix(name, b.prefix) {
+		b.once.Do(b.during)
+	}
+
+	return b.InMemoryBackend.Exists(name)
+}
+
+func Test_ItKeepsChunksReusedByRunningBackups(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V1"), WithDeduplication())
+
+	// Deleting the only backup referring to a chunk orphans it.
+	err := manager.Backup("old.txt", bytes.NewReader([]byte("truth")))
+	assert.NoError(t, err)
+	assert.NoError(t, backend.Delete(lockKey("old.txt")))
+	for name := range backend.Modified {
+		backend.Modified[name] = time.Now().Add(-2 * time.Hour)
+	}
+
+	// GC runs while a backup of the same contents reuses the orphaned chunk.
+	var orphans []Orphan
+	interleaved := interleavingBackend{backend, "chunks/", func() {
+		orphans, err = manager.GC(time.Hour, false)
+	}, &sync.Once{}}
+	err = NewManager(interleaved, newStaticVersioner("V1"), WithDeduplication()).Backup("truth.txt", bytes.NewReader([]byte("truth")))
+	assert.NoError(t, err)
+	assert.Len(t, orphans, 1)
+	assert.Equal(t, versionKey("old.txt", "V1"), orphans[0].Name)
+
+	reader, err := manager.Restore("truth.txt")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("truth"), restored)
+}
+
+func Test_ItKeepsEveryConcurrentLockUpdate(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	for i := 0; i < 8; i++ {
+		manager.versioner = newStaticVersioner(fmt.Sprintf("V%d", i))
+		err := manager.Backup("truth.txt", bytes.NewReader([]byte("truth")))
+		assert.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(version string) {
+			defer wg.Done()
+			_, err := manager.Pin("truth.txt", version, "keep")
+			errs <- err
+		}(fmt.Sprintf("V%d", i))
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	for _, version := range versions {
+		assert.NotNil(t, version.Pin, version.ID)
+	}
+}
+
+func Test_ItRunsOneBackupOfANameAtATime(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	held, err := manager.acquireLease("truth.txt")
+	assert.NoError(t, err)
+
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("truth")))
+	assert.IsType(t, LeaseHeld{}, err)
+
+	// Other names are not affected.
+	err = manager.Backup("secrets.txt", bytes.NewReader([]byte("hunter2")))
+	assert.NoError(t, err)
+
+	assert.NoError(t, held.release())
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("truth")))
+	assert.NoError(t, err)
+
+	lease, err := manager.Lease("truth.txt")
+	assert.NoError(t, err)
+	assert.Nil(t, lease)
+}
+
+func Test_ItTakesOverExpiredLeases(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithLeaseTTL(time.Millisecond))
+
+	// A backup that stopped without releasing its lease.
+	held, err := manager.acquireLease("truth.txt")
+	assert.NoError(t, err)
+	close(held.stop)
+	<-held.done
+	time.Sleep(5 * time.Millisecond)
+
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("truth")))
+	assert.NoError(t, err)
+
+	// A lease can also be removed by hand.
+	_, err = manager.acquireLease("truth.txt")
+	assert.NoError(t, err)
+
+	lease, err := manager.Unlock("truth.txt")
+	assert.NoError(t, err)
+	assert.NotNil(t, lease)
+	assert.NotContains(t, backend.Backups, leaseKey("truth.txt"))
+}
+
+// conflictingBackend is a backend whose lock is always changed by another
+// writer before it can be stored.
+type conflictingBackend struct {
+	*InMemoryBackend
+}
+
+func (b conflictingBackend) StoreIf(name string, reader io.Reader, tag string) error {
+	if strings.HasSuffix(name, "/lock") {
+		return Conflict{name}
+	}
+
+	return b.InMemoryBackend.StoreIf(name, reader, tag)
+}
+
+func Test_ItFailsWithAConflictWhenTheLockKeepsChanging(t *testing.T) {
+	backend := conflictingBackend{NewInMemoryBackend()}
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	err := manager.Backup("truth.txt", bytes.NewReader([]byte("truth")))
+	assert.Equal(t, Conflict{lockKey("truth.txt")}, err)
+}
+
+func Test_ItRecordsAndAppliesFileMetadata(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metadata")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := dir + "/truth.txt"
+	assert.NoError(t, ioutil.WriteFile(path, []byte("truth"), 0640))
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("truth")), WithMetadata(NewFileMetadata(path, info)))
+	assert.NoError(t, err)
+
+	current, err := manager.Current("truth.txt")
+	assert.NoError(t, err)
+	metadata := current.Metadata
+	assert.Equal(t, path, metadata.Path)
+	assert.Equal(t, os.FileMode(0640), metadata.Mode)
+	assert.Equal(t, os.Getuid(), metadata.UID)
+
+	restored := dir + "/restored.txt"
+	assert.NoError(t, ioutil.WriteFile(restored, []byte("truth"), 0666))
+	assert.NoError(t, metadata.Apply(restored, false))
+
+	info, err = os.Stat(restored)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode())
+	assert.True(t, modTime.Equal(info.ModTime()))
+}
+
+func Test_ItMigratesLocksOfEarlierFormats(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithSigningKey(privateKey), WithVerifyKey(publicKey))
+
+	// A signed lock as written before locks had a format.
+	legacy, err := Lock{Name: "/srv/truth.txt", Current: "/srv/truth.txt_V2.bak", Previous: "/srv/truth.txt_V1.bak"}.Sign(privateKey)
+	assert.NoError(t, err)
+	legacyBytes, err := json.Marshal(legacy)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(legacyBytes), "format")
+	backend.Backups["/srv/truth.txt.lock"] = legacyBytes
+
+	err = manager.Backup("/srv/secrets.txt", bytes.NewReader([]byte("hunter2")))
+	assert.NoError(t, err)
+
+	migrations, err := manager.Migrate(true)
+	assert.NoError(t, err)
+	assert.Equal(t, []Migration{{Name: "/srv/truth.txt", From: 0, To: LockFormat, Moved: true}}, migrations)
+	assert.NotContains(t, backend.Backups, lockKey("/srv/truth.txt"))
+
+	migrations, err = manager.Migrate(false)
+	assert.NoError(t, err)
+	assert.Len(t, migrations, 1)
+	assert.Equal(t, legacyBytes, backend.Backups["/srv/truth.txt.lock"])
+
+	lock, err := NewLockFromBytes(backend.Backups[lockKey("/srv/truth.txt")])
+	assert.NoError(t, err)
+	assert.Equal(t, LockFormat, lock.Format)
+	assert.Len(t, lock.Versions, 2)
+	assert.NoError(t, lock.Verify(publicKey))
+
+	// Migrating again changes nothing.
+	migrated := backend.Backups[lockKey("/srv/truth.txt")]
+	migrations, err = manager.Migrate(false)
+	assert.NoError(t, err)
+	assert.Empty(t, migrations)
+	assert.Equal(t, migrated, backend.Backups[lockKey("/srv/truth.txt")])
+
+	versions, err := manager.Versions("/srv/truth.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "/srv/truth.txt_V2.bak", versions[1].ID)
+}
+
+func Test_ItRefusesLocksOfLaterFormats(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	backend.Backups[lockKey("truth.txt")] = []byte(fmt.Sprintf(`{"format":%d,"name":"truth.txt","current":"backups/truth.txt/versions/V1"}`, LockFormat+1))
+
+	_, err := manager.Restore("truth.txt")
+	assert.Equal(t, UnsupportedFormat{lockKey("truth.txt"), LockFormat + 1}, err)
+
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("truth")))
+	assert.Error(t, err)
+}
+
+func Test_ItRebuildsMissingAndCorruptLocks(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("20260101T000000"))
+
+	err := manager.Backup("truth.txt", bytes.NewReader([]byte("V1")))
+	assert.NoError(t, err)
+
+	manager.versioner = newStaticVersioner("20260102T000000")
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("V2")))
+	assert.NoError(t, err)
+
+	deduplicating := NewManager(backend, newStaticVersioner("20260101T000000"), WithDeduplication())
+	err = deduplicating.Backup("secrets.txt", bytes.NewReader([]byte("hunter2")))
+	assert.NoError(t, err)
+
+	err = manager.Backup("healthy.txt", bytes.NewReader([]byte("healthy")))
+	assert.NoError(t, err)
+
+	delete(backend.Backups, lockKey("truth.txt"))
+	backend.Backups[lockKey("secrets.txt")] = []byte("{corrupt")
+
+	repairs, err := manager.Repair(true)
+	assert.NoError(t, err)
+	assert.Len(t, repairs, 2)
+	assert.NotContains(t, backend.Backups, lockKey("truth.txt"))
+
+	repairs, err = manager.Repair(false)
+	assert.NoError(t, err)
+	assert.Len(t, repairs, 2)
+	assert.Equal(t, "secrets.txt", repairs[0].Name)
+	assert.True(t, repairs[0].Rebuilt)
+	assert.Equal(t, LayoutChunked, repairs[0].Versions[0].Layout)
+	assert.Equal(t, "truth.txt", repairs[1].Name)
+	assert.True(t, repairs[1].Rebuilt)
+
+	for name, contents := range map[string]string{"truth.txt": "V2", "secrets.txt": "hunter2", "healthy.txt": "healthy"} {
+		reader, err := manager.Restore(name)
+		assert.NoError(t, err)
+
+		restored, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(contents), restored)
+	}
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	assert.Equal(t, versionKey("truth.txt", "20260101T000000"), versions[0].ID)
+
+	// Healthy locks whose versions are missing are reported, not changed.
+	delete(backend.Backups, versionKey("healthy.txt", "20260102T000000"))
+	repairs, err = manager.Repair(false)
+	assert.NoError(t, err)
+	assert.Len(t, repairs, 1)
+	assert.Equal(t, "healthy.txt", repairs[0].Name)
+	assert.False(t, repairs[0].Rebuilt)
+	assert.Len(t, repairs[0].Problems, 1)
+}
+
+func Test_ItCreatesUniqueSortableVersions(t *testing.T) {
+	versioner := NewMonotonicVersioner()
+
+	previous := ""
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		version := versioner.GetVersion()
+		assert.False(t, seen[version], version)
+		assert.True(t, version > previous, version)
+		assert.NotContains(t, version, "_")
+		seen[version] = true
+		previous = version
+	}
+
+	created, ok := versionTime(previous)
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), created, time.Minute)
+}
+
+func Test_ItVersionsByContentWithAContentVersioner(t *testing.T) {
+	backend := NewInMemoryBackend()
+	first := NewManager(backend, NewHashVersioner())
+	second := NewManager(backend, NewHashVersioner())
+
+	err := first.Backup("config", bytes.NewReader([]byte("V1")))
+	assert.NoError(t, err)
+	sum := sha256.Sum256([]byte("V1"))
+	v1 := versionKey("config", hex.EncodeToString(sum[:])[:hashVersionLength])
+	assert.Contains(t, backend.Backups, v1)
+
+	// Identical contents from another host get the same version.
+	err = second.Backup("config", bytes.NewReader([]byte("V1")))
+	assert.NoError(t, err)
+	versions, err := first.Versions("config")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.NotNil(t, versions[0].VerifiedAt)
+
+	err = first.Backup("config", bytes.NewReader([]byte("V2")))
+	assert.NoError(t, err)
+
+	// Returning to earlier contents makes their version current again.
+	err = second.Backup("config", bytes.NewReader([]byte("V1")))
+	assert.NoError(t, err)
+
+	current, err := first.Current("config")
+	assert.NoError(t, err)
+	assert.Equal(t, v1, current.ID)
+
+	versions, err = first.Versions("config")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+}
+
+func Test_ItEncodesNamesIntoUnambiguousKeys(t *testing.T) {
+	for _, name := range []string{"/etc/nginx", "etc/nginx", "foo_bar", "100%", "..", "/etc/ngin%78"} {
+		name2, rest, ok := parseKey(lockKey(name))
+		assert.True(t, ok, name)
+		assert.Equal(t, name, name2)
+		assert.Equal(t, "lock", rest)
+	}
+	assert.Equal(t, "backups/%2Fetc%2Fnginx/lock", lockKey("/etc/nginx"))
+	assert.NotEqual(t, lockKey("/etc/nginx"), lockKey("etc/nginx"))
+	assert.Equal(t, "backups/%2E%2E/lock", lockKey(".."))
+
+	// Versions of names sharing a prefix can't collide.
+	assert.NotEqual(t, versionKey("foo_bar", "V"), versionKey("foo", "bar_V"))
+	name, version, ok := parseVersionKey(versionKey("foo", "bar_V"))
+	assert.True(t, ok)
+	assert.Equal(t, "foo", name)
+	assert.Equal(t, "bar_V", version)
+	_, _, ok = parseVersionKey(versionKey("foo", "V") + ".shard0")
+	assert.False(t, ok)
+
+	relative, err := CanonicalPath("etc/../etc/nginx")
+	assert.NoError(t, err)
+	wd, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.ToSlash(wd)+"/etc/nginx", relative)
+}
+
+func Test_ItReadsBackupsOfTheLegacyKeyLayout(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V2"))
+
+	contents := []byte("Nothing is certain but death and taxes.")
+	sum := sha256.Sum256(contents)
+	backend.Backups["truth.txt_V1.bak"] = contents
+	lock := NewLock("truth.txt", "truth.txt_V1.bak", "")
+	lock = lock.Record(Version{ID: "truth.txt_V1.bak", Size: int64(len(contents)), Checksum: hex.EncodeToString(sum[:])})
+	backend.Backups["truth.txt.lock"], _ = json.Marshal(lock)
+
+	reader, err := manager.RestoreVersion("truth.txt", "V1")
+	assert.NoError(t, err)
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, restored)
+
+	err = manager.Backup("truth.txt", bytes.NewReader([]byte("Everything is certain.")))
+	assert.NoError(t, err)
+	assert.Contains(t, backend.Backups, versionKey("truth.txt", "V2"))
+
+	// Legacy versions are still referenced once the lock has moved.
+	for name := range backend.Backups {
+		backend.Modified[name] = time.Now().Add(-48 * time.Hour)
+	}
+	orphans, err := manager.GC(24*time.Hour, false)
+	assert.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	versions, err := manager.Versions("truth.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "truth.txt_V1.bak", versions[0].ID)
+	assert.Equal(t, versionKey("truth.txt", "V2"), versions[1].ID)
+}
+
+func Test_ItSelectsVersionsByLabel(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V1"))
+
+	err := manager.Backup("nginx.conf", bytes.NewReader([]byte("V1")), WithLabels(Labels{"release": "v4.1"}))
+	assert.NoError(t, err)
+
+	manager.versioner = newStaticVersioner("V2")
+	err = manager.Backup("nginx.conf", bytes.NewReader([]byte("V2")), WithLabels(Labels{"release": "v4.2", "reason": "pre-upgrade"}))
+	assert.NoError(t, err)
+
+	// Unchanged contents are labeled in place of a new version.
+	manager.versioner = newStaticVersioner("V3")
+	err = manager.Backup("nginx.conf", bytes.NewReader([]byte("V2")), SkipUnchanged(), WithLabels(Labels{"verified": "yes"}))
+	assert.NoError(t, err)
+
+	err = manager.Backup("nginx.conf", bytes.NewReader([]byte("V3")), WithLabels(Labels{"bad key": "x"}))
+	assert.Error(t, err)
+
+	selector, err := ParseSelector([]string{"release=v4.2"})
+	assert.NoError(t, err)
+	version, err := manager.Latest("nginx.conf", selector)
+	assert.NoError(t, err)
+	assert.Equal(t, versionKey("nginx.conf", "V2"), version.ID)
+	assert.Equal(t, "reason=pre-upgrade,release=v4.2,verified=yes", version.Labels.String())
+
+	for expressions, count := range map[string]int{"release": 2, "!reason": 1, "release!=v4.2": 1, "release=v4.2,reason=pre-upgrade": 1, "release=v5": 0, "": 2} {
+		selector, err := ParseSelector(strings.FieldsFunc(expressions, func(r rune) bool { return r == ',' }))
+		assert.NoError(t, err)
+		versions, err := manager.Select("nginx.conf", selector)
+		assert.NoError(t, err)
+		assert.Len(t, versions, count, expressions)
+	}
+
+	_, err = manager.Latest("nginx.conf", Selector{{Key: "release", Value: "v5", HasValue: true}})
+	assert.Error(t, err)
+
+	_, err = ParseSelector([]string{"!"})
+	assert.Error(t, err)
+	_, err = ParseLabels([]string{"release"})
+	assert.Error(t, err)
+}
+
+func Test_ItRecordsWhyAndByWhomVersionsWereBackedUp(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	err := manager.Backup("postgresql.conf", bytes.NewReader([]byte("max_connections = 100")), WithMessage("before upgrading postgres 15->16"))
+	assert.NoError(t, err)
+
+	current, err := manager.Current("postgresql.conf")
+	assert.NoError(t, err)
+	assert.Equal(t, "before upgrading postgres 15->16", current.Message)
+	assert.Equal(t, systools.Version, current.SystoolsVersion)
+
+	hostname, _ := os.Hostname()
+	assert.True(t, strings.HasSuffix(current.Author, "@"+hostname), current.Author)
+}
+
+func Test_ItVerifiesDirectoryVersionsBeforeTheyAreExtracted(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"))
+
+	var tarball bytes.Buffer
+	writer := tar.NewWriter(&tarball)
+	assert.NoError(t, writer.WriteHeader(&tar.Header{Name: "www/index.html", Mode: 0644, Size: 5}))
+	_, err := writer.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+
+	err = manager.Backup("www", bytes.NewReader(tarball.Bytes()))
+	assert.NoError(t, err)
+
+	// Corrupt the padding after the end of the archive, which a tar reader
+	// never reads.
+	stored := backend.Backups[versionKey("www", "VERSION")]
+	stored[len(stored)-1] = 1
+
+	current, err := manager.Current("www")
+	assert.NoError(t, err)
+
+	reader, err := manager.ReadVersion(*current)
+	assert.NoError(t, err)
+	_, err = tar.NewReader(reader).Next()
+	assert.NoError(t, err)
+
+	_, cleanup, err := manager.ReadVerifiedVersion(*current)
+	defer cleanup()
+	assert.Equal(t, ChecksumMismatch{versionKey("www", "VERSION")}, err)
+}
+
+func Test_ItStopsReadingAheadWhenClosed(t *testing.T) {
+	backend := NewInMemoryBackend()
+	backend.Backups["dump.sql"] = make([]byte, 64)
+
+	// Ranges past the end of the name are empty rather than out of bounds.
+	reader, err := backend.ReadRange("dump.sql", 128, 16)
+	assert.NoError(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Empty(t, contents)
+
+	parallel := newParallelReader(backend, "dump.sql", 64, 1, 2)
+	_, err = parallel.Read(make([]byte, 1))
+	assert.NoError(t, err)
+
+	closed := make(chan error)
+	go func() {
+		closed <- parallel.Close()
+	}()
+
+	select {
+	case err = <-closed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("the reader kept waiting to download the next range")
+	}
+
+	select {
+	case <-parallel.done:
+	default:
+		t.Fatal("the reader was closed before it stopped downloading ranges")
+	}
+}
+
+// truncatingBackend fails every read after a number of bytes have been read.
+type truncatingBackend struct {
+	*InMemoryBackend
+	after int64
+}
+
+func (b truncatingBackend) Read(name string) (io.Reader, error) {
+	reader, err := b.InMemoryBackend.Read(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.MultiReader(io.LimitReader(reader, b.after), iotest.ErrReader(errors.New("connection reset"))), nil
+}
+
+func Test_ItReconstructsShardsThatFailPartwayThrough(t *testing.T) {
+	var shardBackends []ShardBackend
+	var memoryBackends []*InMemoryBackend
+	for _, name := range []string{"aws", "do", "gcs", "b2", "wasabi"} {
+		backend := NewInMemoryBackend()
+		memoryBackends = append(memoryBackends, backend)
+		shardBackends = append(shardBackends, ShardBackend{Name: name, Backend: backend})
+	}
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"), WithShardBackends(shardBackends...), WithErasureCoding(3, 2))
+
+	contents := make([]byte, 7*1024*1024+3)
+	rand.New(rand.NewSource(1)).Read(contents)
+
+	err := manager.Backup("dump.sql", bytes.NewReader(contents))
+	assert.NoError(t, err)
+
+	// A data shard fails in the middle of the second stripe.
+	shardBackends[1].Backend = truncatingBackend{memoryBackends[1], shardBlockSize + shardBlockSize/2}
+	manager = NewManager(backend, newStaticVersioner("VERSION"), WithShardBackends(shardBackends...), WithErasureCoding(3, 2))
+
+	reader, err := manager.Restore("dump.sql")
+	assert.NoError(t, err)
+
+	restored, err := ioutil.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, contents, restored)
+}
+
+func Test_ItRenamesLocksToTheirCanonicalNamesWhenMigrating(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V2"))
+
+	// Earlier versions of systools named backups by relative paths.
+	for _, name := range []string{"notes.txt", "truth.txt"} {
+		backend.Backups[legacyVersionKey(name, "V1")] = []byte("V1")
+		lock := NewLock(name, legacyVersionKey(name, "V1"), "")
+		if name == "truth.txt" {
+			lock = lock.Record(Version{ID: lock.Current, Metadata: &FileMetadata{Path: filepath.FromSlash("/srv/truth.txt")}})
+		}
+		backend.Backups[legacyLockKey(name)], _ = json.Marshal(lock)
+	}
+
+	canonical, err := CanonicalPath(filepath.FromSlash("/srv/truth.txt"))
+	assert.NoError(t, err)
+
+	migrations, err := manager.Migrate(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Migration{
+		{Name: "notes.txt", From: LockFormat, To: LockFormat, Moved: true, Unresolved: "no version records the path it was backed up from"},
+		{Name: "truth.txt", From: LockFormat, To: LockFormat, Moved: true, Canonical: canonical},
+	}, migrations)
+	assert.NotContains(t, backend.Backups, legacyLockKey("truth.txt"))
+	assert.NotContains(t, backend.Backups, lockKey("truth.txt"))
+
+	versions, err := manager.Versions(canonical)
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.Equal(t, legacyVersionKey("truth.txt", "V1"), versions[0].ID)
+
+	// Locks that can't be renamed are reported every time.
+	migrations, err = manager.Migrate(false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Migration{{Name: "notes.txt", From: LockFormat, To: LockFormat, Unresolved: "no version records the path it was backed up from"}}, migrations)
+}
+
+func Test_ItErasureCodesTransformedContents(t *testing.T) {
+	var shardBackends []ShardBackend
+	for _, name := range []string{"aws", "do", "gcs", "b2", "wasabi"} {
+		shardBackends = append(shardBackends, ShardBackend{Name: name, Backend: NewInMemoryBackend()})
+	}
+
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("VERSION"),
+		WithShardBackends(shardBackends...), WithErasureCoding(3, 2), WithTransformers(GzipTransformer{}))
+
+	// Random contents grow when compressed, and repeated ones shrink.
+	random := make([]byte, 4*1024*1024+7)
+	rand.New(rand.NewSource(1)).Read(random)
+	repeated := bytes.Repeat([]byte("Nothing is certain but death and taxes. "), 100000)
+
+	for i, contents := range [][]byte{random, repeated} {
+		name := fmt.Sprintf("dump%d.sql", i)
+		err := manager.Backup(name, bytes.NewReader(contents))
+		assert.NoError(t, err)
+
+		reader, err := manager.Restore(name)
+		assert.NoError(t, err)
+
+		restored, err := ioutil.ReadAll(reader)
+		assert.NoError(t, err)
+		assert.Equal(t, contents, restored)
+	}
+}
+
+// brokenBackend fails every store after reading the first bytes.
+type brokenBackend struct {
+	*InMemoryBackend
+}
+
+func (b brokenBackend) Store(name string, reader io.Reader) error {
+	if _, err := reader.Read(make([]byte, 16)); err != nil {
+		return err
+	}
+
+	return errors.New("connection reset")
+}
+
+// notifyingTransformer encodes contents as they are, and closes `closed` once
+// encoding stops.
+type notifyingTransformer struct {
+	closed chan struct{}
+}
+
+func (t notifyingTransformer) Name() string {
+	return "notifying"
+}
+
+func (t notifyingTransformer) Encode(reader io.Reader) (io.Reader, error) {
+	return pipeEncoder(reader, func(writer io.Writer) io.WriteCloser {
+		return notifyingWriter{writer, t.closed}
+	}), nil
+}
+
+func (t notifyingTransformer) Decode(reader io.Reader) (io.Reader, error) {
+	return reader, nil
+}
+
+type notifyingWriter struct {
+	io.Writer
+	closed chan struct{}
+}
+
+func (w notifyingWriter) Close() error {
+	close(w.closed)
+	return nil
+}
+
+func Test_ItStopsEncodingWhenAStoreFails(t *testing.T) {
+	transformer := notifyingTransformer{make(chan struct{})}
+	manager := NewManager(brokenBackend{NewInMemoryBackend()}, newStaticVersioner("VERSION"), WithTransformers(transformer, GzipTransformer{}))
+
+	err := manager.Backup("dump.sql", bytes.NewReader(make([]byte, 1024*1024)))
+	assert.Error(t, err)
+
+	select {
+	case <-transformer.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the encoder kept waiting to write the rest of the contents")
+	}
+}
+
+// unreliableBackend fails, or returns `corrupt` contents, for the first
+// `failures` reads of `name`.
+type unreliableBackend struct {
+	*InMemoryBackend
+	name     string
+	corrupt  []byte
+	failures *int
+}
+
+func (b unreliableBackend) ReadTagged(name string) (io.Reader, string, error) {
+	if name == b.name && *b.failures > 0 {
+		*b.failures--
+		if b.corrupt != nil {
+			return bytes.NewReader(b.corrupt), "", nil
+		}
+		return nil, "", errors.New("connection reset")
+	}
+
+	return b.InMemoryBackend.ReadTagged(name)
+}
+
+func Test_ItOnlyRebuildsLocksThatAreCorrupt(t *testing.T) {
+	backend := NewInMemoryBackend()
+	manager := NewManager(backend, newStaticVersioner("V1"))
+
+	err := manager.Backup("truth.txt", bytes.NewReader([]byte("V1")), WithLabels(Labels{"release": "v1"}))
+	assert.NoError(t, err)
+	intact := backend.Backups[lockKey("truth.txt")]
+
+	// A lock that fails to be read aborts the repair.
+	failures := 1
+	unreliable := NewManager(unreliableBackend{backend, lockKey("truth.txt"), nil, &failures}, newStaticVersioner("V1"))
+	_, err = unreliable.Repair(false)
+	assert.Error(t, err)
+	assert.Equal(t, intact, backend.Backups[lockKey("truth.txt")])
+
+	// A lock that reads fine again before it is replaced is left as is.
+	failures = 1
+	unreliable = NewManager(unreliableBackend{backend, lockKey("truth.txt"), []byte("{corrupt"), &failures}, newStaticVersioner("V1"))
+	repairs, err := unreliable.Repair(false)
+	assert.NoError(t, err)
+	assert.Len(t, repairs, 1)
+	assert.False(t, repairs[0].Rebuilt)
+	assert.Equal(t, intact, backend.Backups[lockKey("truth.txt")])
+}
@@ -0,0 +1,58 @@
+package backups
+
+import (
+	"os"
+	"time"
+)
+
+// FileMetadata describes the file a version was backed up from, so that a
+// restore can recreate it faithfully.
+type FileMetadata struct {
+	// Path is the absolute path of the file when it was backed up.
+	Path    string      `json:"path"`
+	Mode    os.FileMode `json:"mode"`
+	ModTime time.Time   `json:"mod_time"`
+
+	// UID and GID are the numeric owner of the file, and User and Group
+	// their names, if they could be looked up. They are -1 on platforms
+	// without numeric owners.
+	UID   int    `json:"uid"`
+	GID   int    `json:"gid"`
+	User  string `json:"user,omitempty"`
+	Group string `json:"group,omitempty"`
+}
+
+// NewFileMetadata returns the metadata of the file at absolute path `path`,
+// described by `info`.
+func NewFileMetadata(path string, info os.FileInfo) FileMetadata {
+	metadata := FileMetadata{
+		Path:    path,
+		Mode:    info.Mode(),
+		ModTime: info.ModTime(),
+		UID:     -1,
+		GID:     -1,
+	}
+	readOwner(info, &metadata)
+
+	return metadata
+}
+
+// Apply sets the mode, modification time and, if `ownership` is true, the
+// owner of the file at `path` to those of the metadata. The owner is looked
+// up by name first, so that it is restored correctly on hosts where the
+// same names have different IDs.
+func (m FileMetadata) Apply(path string, ownership bool) error {
+	// Ownership is applied first, since changing it can clear the setuid
+	// and setgid bits.
+	if ownership {
+		if err := applyOwner(path, m); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chmod(path, m.Mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, m.ModTime, m.ModTime)
+}
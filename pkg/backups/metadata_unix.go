@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package backups
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// readOwner fills in the owner of the file described by `info`.
+func readOwner(info os.FileInfo, metadata *FileMetadata) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+
+	metadata.UID = int(stat.Uid)
+	metadata.GID = int(stat.Gid)
+
+	if u, err := user.LookupId(strconv.Itoa(metadata.UID)); err == nil {
+		metadata.User = u.Username
+	}
+	if g, err := user.LookupGroupId(strconv.Itoa(metadata.GID)); err == nil {
+		metadata.Group = g.Name
+	}
+}
+
+// applyOwner changes the owner of the file at `path` to the owner in
+// `metadata`, preferring the IDs of its user and group names on this host.
+func applyOwner(path string, metadata FileMetadata) error {
+	uid, gid := metadata.UID, metadata.GID
+
+	if u, err := user.Lookup(metadata.User); metadata.User != "" && err == nil {
+		if id, err := strconv.Atoi(u.Uid); err == nil {
+			uid = id
+		}
+	}
+	if g, err := user.LookupGroup(metadata.Group); metadata.Group != "" && err == nil {
+		if id, err := strconv.Atoi(g.Gid); err == nil {
+			gid = id
+		}
+	}
+
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+
+	return os.Lchown(path, uid, gid)
+}
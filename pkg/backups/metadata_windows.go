@@ -0,0 +1,11 @@
+package backups
+
+import "os"
+
+// readOwner does nothing, since files have no numeric owner on Windows.
+func readOwner(info os.FileInfo, metadata *FileMetadata) {}
+
+// applyOwner does nothing, since files have no numeric owner on Windows.
+func applyOwner(path string, metadata FileMetadata) error {
+	return nil
+}
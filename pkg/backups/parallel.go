@@ -0,0 +1,269 @@
+package backups
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+)
+
+// DefaultPartSize is the size of each part of a parallel upload or download if
+// no part size is configured. At S3's limit of 10,000 parts per upload, it
+// allows versions of up to 625 GiB.
+const DefaultPartSize = 64 * 1024 * 1024
+
+// storeParallel stores the contents of `reader` under `id` as a multipart
+// upload with up to `m.concurrency` parts being uploaded at once. Contents
+// that fit in a single part are stored as is.
+//
+// If `state` is given, it is persisted as parts are uploaded. If it already
+// has an upload ID, that upload is resumed and parts previously uploaded
+// with identical contents are not uploaded again. On failure, the upload
+// is left in place to be resumed instead of being aborted.
+func (m Manager) storeParallel(id string, reader io.Reader, storer MultipartStorer, state *UploadState) error {
+	first, err := readPart(reader, m.partSize)
+	if err != nil {
+		return err
+	}
+	if int64(len(first)) < m.partSize {
+		if err = m.backend.Store(id, bytes.NewReader(first)); err != nil {
+			return err
+		}
+		return m.finishUpload(state)
+	}
+
+	var uploadID string
+	if state != nil && state.UploadID != "" {
+		uploadID = state.UploadID
+	} else {
+		if uploadID, err = storer.CreateMultipart(id); err != nil {
+			return err
+		}
+		if state != nil {
+			state.UploadID = uploadID
+			if err = m.uploads.Save(*state); err != nil {
+				storer.AbortMultipart(id, uploadID)
+				return err
+			}
+		}
+	}
+
+	parts, err := m.uploadParts(id, uploadID, storer, first, reader, state)
+	if err == nil {
+		err = storer.CompleteMultipart(id, uploadID, parts)
+	}
+	if err != nil {
+		if state == nil {
+			storer.AbortMultipart(id, uploadID)
+		} else if _, ok := err.(NoSuchName); ok {
+			// The upload no longer exists, so there is nothing to resume.
+			m.uploads.Remove(state.Name)
+		}
+		return err
+	}
+
+	return m.finishUpload(state)
+}
+
+// finishUpload removes the persisted state of a finished upload, if any.
+func (m Manager) finishUpload(state *UploadState) error {
+	if state == nil {
+		return nil
+	}
+
+	return m.uploads.Remove(state.Name)
+}
+
+// uploadParts reads `reader` part by part, starting with the already read
+// part `first`, and uploads the parts concurrently. Reading is sequential,
+// so that at most `m.concurrency` parts are held in memory at once.
+func (m Manager) uploadParts(id string, uploadID string, storer MultipartStorer, first []byte, reader io.Reader, state *UploadState) ([]Part, error) {
+	var parts []Part
+	var failure error
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	concurrency := m.concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	tokens := make(chan struct{}, concurrency)
+
+	uploaded := make(map[int]Part)
+	if state != nil {
+		for _, part := range state.Parts {
+			uploaded[part.Number] = part
+		}
+	}
+
+	data := first
+	for number := 1; len(data) > 0; number++ {
+		sum := sha256.Sum256(data)
+		part := Part{Number: number, Size: int64(len(data)), Checksum: hex.EncodeToString(sum[:])}
+
+		if previous, ok := uploaded[number]; ok && previous.Size == part.Size && previous.Checksum == part.Checksum {
+			mu.Lock()
+			parts = append(parts, previous)
+			mu.Unlock()
+		} else {
+			tokens <- struct{}{}
+
+			mu.Lock()
+			failed := failure != nil
+			mu.Unlock()
+			if failed {
+				break
+			}
+
+			wg.Add(1)
+			go func(part Part, data []byte) {
+				defer func() {
+					<-tokens
+					wg.Done()
+				}()
+
+				tag, err := storer.StorePart(id, uploadID, part.Number, bytes.NewReader(data))
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					failure = err
+					return
+				}
+
+				part.Tag = tag
+				parts = append(parts, part)
+				if state != nil {
+					state.Parts = append([]Part{}, parts...)
+					if err = m.uploads.Save(*state); err != nil {
+						failure = err
+					}
+				}
+			}(part, data)
+		}
+
+		var err error
+		if data, err = readPart(reader, m.partSize); err != nil {
+			mu.Lock()
+			failure = err
+			mu.Unlock()
+			break
+		}
+	}
+
+	wg.Wait()
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].Number < parts[j].Number })
+
+	return parts, failure
+}
+
+// readPart reads up to `size` bytes from `reader`. It only returns fewer bytes
+// when the end of `reader` is reached.
+func readPart(reader io.Reader, size int64) ([]byte, error) {
+	return ioutil.ReadAll(io.LimitReader(reader, size))
+}
+
+// parallelReader reads a name in consecutive ranges, downloading up to
+// `concurrency` ranges ahead of the one currently being read. It stops
+// downloading once it is closed, which it is by itself when it returns an
+// error or reaches the end of the name.
+type parallelReader struct {
+	ranges  []chan rangeResult
+	tokens  chan struct{}
+	current io.Reader
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type rangeResult struct {
+	data []byte
+	err  error
+}
+
+func newParallelReader(rangeReader RangeReader, name string, size int64, partSize int64, concurrency int) *parallelReader {
+	r := &parallelReader{
+		tokens: make(chan struct{}, concurrency),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	for offset := int64(0); offset < size; offset += partSize {
+		r.ranges = append(r.ranges, make(chan rangeResult, 1))
+	}
+
+	go func() {
+		defer close(r.done)
+
+		for i, result := range r.ranges {
+			// A token is taken for every range being downloaded or waiting
+			// to be read, and returned once the range is read.
+			select {
+			case r.tokens <- struct{}{}:
+			case <-r.stop:
+				return
+			}
+
+			go func(offset int64, result chan rangeResult) {
+				reader, err := rangeReader.ReadRange(name, offset, partSize)
+				if err != nil {
+					result <- rangeResult{err: err}
+					return
+				}
+
+				data, err := ioutil.ReadAll(reader)
+				result <- rangeResult{data: data, err: err}
+			}(int64(i)*partSize, result)
+		}
+	}()
+
+	return r
+}
+
+func (r *parallelReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.ranges) == 0 {
+				r.Close()
+				return 0, io.EOF
+			}
+
+			result := <-r.ranges[0]
+			r.ranges = r.ranges[1:]
+			<-r.tokens
+
+			if result.err != nil {
+				r.Close()
+				return 0, result.err
+			}
+			r.current = bytes.NewReader(result.data)
+		}
+
+		n, err := r.current.Read(p)
+		if err == io.EOF {
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+// Close stops downloading ranges ahead, so that a reader that is no longer
+// read doesn't keep waiting to download the next range. It returns once no
+// more ranges will be downloaded. Downloads already started finish in the
+// background, since their results are buffered.
+func (r *parallelReader) Close() error {
+	r.closeOnce.Do(func() { close(r.stop) })
+	<-r.done
+
+	return nil
+}
@@ -0,0 +1,75 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Pin marks a version that must be kept forever, regardless of retention.
+type Pin struct {
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// Host is the hostname of the machine the version was pinned from.
+	Host string `json:"host,omitempty"`
+}
+
+// VersionPinned is an error returned when deleting a pinned version.
+type VersionPinned struct {
+	ID     string
+	Reason string
+}
+
+func (e VersionPinned) Error() string {
+	return fmt.Sprintf("version %s is pinned: %s", e.ID, e.Reason)
+}
+
+// Pin marks version `id` of `name` to be kept forever with `reason`, so that
+// it is never deleted until it is unpinned. The version may be given by its
+// full ID or by only the version string it was created with.
+func (m Manager) Pin(name string, id string, reason string) (Version, error) {
+	if reason == "" {
+		return Version{}, errors.New("A reason is required to pin a version")
+	}
+
+	var version Version
+	err := m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		var err error
+		if version, err = findVersion(lock, id); err != nil {
+			return Lock{}, err
+		}
+
+		host, _ := os.Hostname()
+		version.Pin = &Pin{
+			Reason:    reason,
+			CreatedAt: time.Now(),
+			Host:      host,
+		}
+
+		return lock.Record(version), nil
+	})
+
+	return version, err
+}
+
+// Unpin removes the pin from version `id` of `name`.
+func (m Manager) Unpin(name string, id string) (Version, error) {
+	var version Version
+	err := m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		var err error
+		if version, err = findVersion(lock, id); err != nil {
+			return Lock{}, err
+		}
+
+		if version.Pin == nil {
+			return Lock{}, fmt.Errorf("Version %s is not pinned", version.ID)
+		}
+		version.Pin = nil
+
+		return lock.Record(version), nil
+	})
+
+	return version, err
+}
@@ -0,0 +1,366 @@
+package backups
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// versionPattern matches the names version contents are stored under in the
+// legacy key layout, in the format "$name_$version.bak". The versions of the
+// built in versioners never contain an underscore, so the name is everything
+// before the last one.
+var versionPattern = regexp.MustCompile(`^(.+)_([^_]+)\.bak$`)
+
+// maxChunkIndexSize is the size of the largest object that is checked for
+// being a chunk index when rebuilding a lock.
+const maxChunkIndexSize = 64 * 1024 * 1024
+
+// Repair is the outcome of repairing the lock of a single name.
+type Repair struct {
+	Name string
+
+	// Rebuilt is set if the lock was missing or corrupt and was rebuilt, or
+	// would have been on a dry run, from Versions.
+	Rebuilt  bool
+	Versions []Version
+
+	// Problems lists inconsistencies that could not be resolved.
+	Problems []string
+}
+
+// Repair scans the backend for the contents of versions and rebuilds the lock
+// of every name whose lock is missing or can't be decoded from them, with
+// the newest version as the current version. Errors reading a lock from the
+// backend abort the repair, since the lock may well be intact. If `dryRun`
+// is true, the locks are not stored. It returns a Repair for each name that
+// was rebuilt or has problems that could not be resolved, such as versions
+// whose contents are missing. The backend must implement Lister.
+//
+// Rebuilt locks can't record what was lost with the original lock: version
+// checksums, transforms, parents of incremental versions and the shard
+// layouts of erasure coded versions. Versions are assumed to be stored as
+// is or as chunks, and each such loss is reported as a problem.
+func (m Manager) Repair(dryRun bool) ([]Repair, error) {
+	lister, ok := m.backend.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("The backend does not support listing objects")
+	}
+
+	objects, err := lister.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	stored := make(map[string]Object)
+	for _, object := range objects {
+		stored[object.Name] = object
+	}
+
+	// Find every name with a lock or stored versions, and check the locks
+	// that can be read, claiming the versions they refer to.
+	var repairs []Repair
+	names := make(map[string]bool)
+	healthy := make(map[string]bool)
+	broken := make(map[string]error)
+	claimed := make(map[string]bool)
+	for _, name := range lockNames(objects) {
+		names[name] = true
+	}
+	for _, object := range objects {
+		if name, _, ok := parseVersionKey(object.Name); ok {
+			names[name] = true
+		}
+	}
+
+	shards, err := m.storedShards(objects)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range shards {
+		if name, _, ok := parseVersionKey(id); ok {
+			names[name] = true
+		}
+	}
+
+	for _, name := range sortedNames(names) {
+		lock, _, err := m.readLock(name)
+		switch err.(type) {
+		case nil:
+		case CorruptLock, UnsupportedFormat, InvalidSignature:
+			broken[name] = err
+			continue
+		default:
+			// The lock may be fine, and only failed to be read.
+			return nil, fmt.Errorf("Unable to read the lock of %s: %v", name, err)
+		}
+		if lock == nil {
+			continue
+		}
+		healthy[name] = true
+
+		repair := Repair{Name: name}
+		for _, version := range lock.Upgrade().History() {
+			claimed[version.ID] = true
+			if version.Layout != LayoutErasure {
+				if _, ok := stored[version.ID]; !ok {
+					repair.Problems = append(repair.Problems, fmt.Sprintf("The contents of version %s are missing", version.ID))
+				}
+			}
+		}
+
+		if len(repair.Problems) > 0 {
+			repairs = append(repairs, repair)
+		}
+	}
+
+	// Rebuild the locks that are missing or broken from the versions no
+	// readable lock refers to.
+	unclaimed := make(map[string][]Object)
+	for _, object := range objects {
+		if name, _, ok := parseVersionKey(object.Name); ok && !claimed[object.Name] {
+			for broken := range broken {
+				// A broken lock's name is known, so legacy versions
+				// containing underscores are still found.
+				if isLegacyVersionOf(object.Name, broken) && len(broken) < len(name) {
+					name = broken
+				}
+			}
+			unclaimed[name] = append(unclaimed[name], object)
+		}
+	}
+
+	for _, name := range sortedNames(names) {
+		lockErr, isBroken := broken[name]
+		var lostShards []string
+		for _, id := range shards {
+			owner, _, _ := parseVersionKey(id)
+			if (owner == name || isLegacyVersionOf(id, name)) && !claimed[id] {
+				lostShards = append(lostShards, id)
+			}
+		}
+
+		if healthy[name] || (!isBroken && len(unclaimed[name]) == 0 && len(lostShards) == 0) {
+			continue
+		}
+
+		repair, err := m.rebuildLock(name, unclaimed[name], stored, lockErr, dryRun)
+		if err != nil {
+			return repairs, err
+		}
+
+		for _, id := range lostShards {
+			repair.Problems = append(repair.Problems, fmt.Sprintf("Version %s is erasure coded and its shard layout could not be recovered", id))
+		}
+
+		repairs = append(repairs, repair)
+	}
+
+	sort.Slice(repairs, func(i, j int) bool { return repairs[i].Name < repairs[j].Name })
+
+	return repairs, nil
+}
+
+// rebuildLock rebuilds the lock of `name` from `objects`, the stored contents
+// of its versions. `lockErr` is the error reading its lock, if it exists.
+func (m Manager) rebuildLock(name string, objects []Object, stored map[string]Object, lockErr error, dryRun bool) (Repair, error) {
+	repair := Repair{Name: name}
+
+	if lockErr != nil {
+		switch lockErr.(type) {
+		case UnsupportedFormat:
+			// The lock is fine, this version of systools is too old.
+			repair.Problems = append(repair.Problems, lockErr.Error())
+			return repair, nil
+		case InvalidSignature:
+			// The lock may have been tampered with, and so may the
+			// versions it would be rebuilt from.
+			repair.Problems = append(repair.Problems, fmt.Sprintf("The lock was left for inspection, since %v", lockErr))
+			return repair, nil
+		}
+
+		repair.Problems = append(repair.Problems, fmt.Sprintf("The lock could not be read and was replaced: %v", lockErr))
+	}
+
+	if len(objects) == 0 {
+		repair.Problems = append(repair.Problems, "No versions were found to rebuild the lock from")
+		return repair, nil
+	}
+
+	for _, object := range objects {
+		version, err := m.recoverVersion(name, object, stored)
+		if err != nil {
+			return repair, err
+		}
+		repair.Versions = append(repair.Versions, version)
+	}
+
+	sort.SliceStable(repair.Versions, func(i, j int) bool {
+		return repair.Versions[i].CreatedAt.Before(repair.Versions[j].CreatedAt)
+	})
+
+	repair.Problems = append(repair.Problems, "The checksums and transforms of the versions could not be recovered, so restores are not verified")
+	for _, version := range repair.Versions {
+		if version.Manifest != "" {
+			repair.Problems = append(repair.Problems, fmt.Sprintf("Version %s may be incremental, but its parent could not be recovered", version.ID))
+		}
+	}
+
+	lock := NewLock(name, "", "")
+	for _, version := range repair.Versions {
+		lock = lock.Shift(version.ID).Record(version)
+	}
+	repair.Rebuilt = true
+
+	if dryRun {
+		return repair, nil
+	}
+
+	if m.verifyKey != nil && m.signingKey == nil {
+		return repair, fmt.Errorf("Locks are verified, so rebuilding the lock of %s requires a signing key", name)
+	}
+
+	// The lock is read again, and left as is if it can be read now, such as
+	// when a backup stored it in the meantime. Otherwise it is only replaced
+	// if it hasn't changed since, or created if it still doesn't exist.
+	current, tag, err := m.readLock(name)
+	if current != nil {
+		return Repair{Name: name, Problems: []string{"The lock could be read again, so it was left as is"}}, nil
+	}
+	if _, ok := err.(CorruptLock); err != nil && !ok {
+		return repair, err
+	}
+
+	return repair, m.storeLock(lock, tag)
+}
+
+// recoverVersion returns the record of the version stored as `object`, with
+// what can be recovered from the stored objects.
+func (m Manager) recoverVersion(name string, object Object, stored map[string]Object) (Version, error) {
+	version := Version{
+		ID:        object.Name,
+		Size:      object.Size,
+		CreatedAt: object.LastModified,
+	}
+
+	// Versions of the built in versioners record when they were created.
+	id := ShortVersion(object.Name)
+	if isLegacyVersionOf(object.Name, name) {
+		id = strings.TrimSuffix(strings.TrimPrefix(object.Name, name+"_"), ".bak")
+	}
+	if created, ok := versionTime(id); ok {
+		version.CreatedAt = created
+	}
+
+	manifest := manifestKey(object.Name)
+	if _, ok := stored[manifest]; ok {
+		reader, err := m.backend.Read(manifest)
+		if err != nil {
+			return version, err
+		}
+
+		summer := newSummingReader(reader)
+		if _, err = ioutil.ReadAll(summer); err != nil {
+			return version, err
+		}
+		version.Manifest = manifest
+		version.ManifestChecksum = summer.Checksum()
+	}
+
+	if object.Size <= maxChunkIndexSize {
+		index, ok, err := m.detectChunkIndex(object.Name)
+		if err != nil {
+			return version, err
+		}
+
+		if ok {
+			version.Layout = LayoutChunked
+			version.Size = 0
+			for _, chunk := range index.Chunks {
+				version.Size += chunk.Size
+			}
+		}
+	}
+
+	return version, nil
+}
+
+// detectChunkIndex returns the chunk index stored under `id`, and whether the
+// object is a chunk index at all rather than the contents of a version.
+func (m Manager) detectChunkIndex(id string) (ChunkIndex, bool, error) {
+	var index ChunkIndex
+
+	reader, err := m.backend.Read(id)
+	if err != nil {
+		return index, false, err
+	}
+
+	contents, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return index, false, err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(contents))
+	decoder.DisallowUnknownFields()
+	if err = decoder.Decode(&index); err != nil || len(index.Chunks) == 0 || index.Format > ChunkIndexFormat {
+		return index, false, nil
+	}
+
+	for _, chunk := range index.Chunks {
+		found, err := exists(m.backend, chunk.ID())
+		if err != nil {
+			return index, false, err
+		}
+		if len(chunk.Hash) != 64 || !found {
+			return index, false, nil
+		}
+	}
+
+	return index, true, nil
+}
+
+// storedShards returns the IDs of the erasure coded versions with shards
+// among `objects` or on any shard backend that implements Lister.
+func (m Manager) storedShards(objects []Object) ([]string, error) {
+	ids := make(map[string]bool)
+	addShards := func(objects []Object) {
+		for _, object := range objects {
+			if shardPattern.MatchString(object.Name) {
+				ids[object.Name[:strings.LastIndex(object.Name, ".shard")]] = true
+			}
+		}
+	}
+
+	addShards(objects)
+	for _, shardBackend := range m.shardBackends {
+		if lister, ok := shardBackend.Backend.(Lister); ok {
+			objects, err := lister.List("")
+			if err != nil {
+				return nil, fmt.Errorf("Unable to list shard backend %s: %v", shardBackend.Name, err)
+			}
+			addShards(objects)
+		}
+	}
+
+	return sortedNames(ids), nil
+}
+
+// isLegacyVersionOf returns whether `id` may be the ID of a version of `name`
+// stored in the legacy key layout.
+func isLegacyVersionOf(id string, name string) bool {
+	return strings.HasPrefix(id, name+"_") && strings.HasSuffix(id, ".bak")
+}
+
+func sortedNames(names map[string]bool) []string {
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	return sorted
+}
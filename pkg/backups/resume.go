@@ -0,0 +1,116 @@
+package backups
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// staleUploadAge is the age after which an unfinished upload is no longer
+// resumed, since backends may have expired its parts by then.
+const staleUploadAge = 7 * 24 * time.Hour
+
+// UploadState is the locally persisted state of an unfinished multipart upload
+// of a version, which allows a later backup of the same name to resume it.
+type UploadState struct {
+	Name     string `json:"name"`
+	ID       string `json:"id"`
+	UploadID string `json:"upload_id"`
+
+	// Source identifies the contents being uploaded, such as a file's path,
+	// size and modification time. An upload is only resumed if the source
+	// of the new backup is identical.
+	Source string `json:"source"`
+
+	PartSize  int64     `json:"part_size"`
+	Parts     []Part    `json:"parts"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// UploadStateStore persists the UploadState of each name in a directory.
+type UploadStateStore struct {
+	dir string
+}
+
+// NewUploadStateStore returns an UploadStateStore persisting state in `dir`.
+func NewUploadStateStore(dir string) UploadStateStore {
+	return UploadStateStore{dir}
+}
+
+// Load returns the state of the unfinished upload of `name`, or nil if there
+// is none.
+func (s UploadStateStore) Load(name string) (*UploadState, error) {
+	contents, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var state UploadState
+	if err = json.Unmarshal(contents, &state); err != nil {
+		// A state file corrupted by a crash mid-write can't be resumed.
+		return nil, s.Remove(name)
+	}
+
+	return &state, nil
+}
+
+// Save persists `state`, replacing any previous state of the same name.
+func (s UploadStateStore) Save(state UploadState) error {
+	if err := os.MkdirAll(s.dir, 0700); err != nil {
+		return err
+	}
+
+	contents, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so that a crash never leaves a
+	// partially written state file behind.
+	path := s.path(state.Name)
+	if err = ioutil.WriteFile(path+".tmp", contents, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+// Remove removes the state of `name`, if any.
+func (s UploadStateStore) Remove(name string) error {
+	if err := os.Remove(s.path(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (s UploadStateStore) path(name string) string {
+	sum := sha256.Sum256([]byte(name))
+
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// resumableUpload returns the state of the upload to resume for `name` from
+// `source`. Unfinished uploads from a different source or that are too old
+// to resume are aborted and their state removed, returning nil.
+func (m Manager) resumableUpload(name string, source string, storer MultipartStorer) (*UploadState, error) {
+	state, err := m.uploads.Load(name)
+	if err != nil || state == nil {
+		return nil, err
+	}
+
+	if state.Source == source && state.PartSize == m.partSize && time.Since(state.CreatedAt) < staleUploadAge {
+		return state, nil
+	}
+
+	// The abort is best effort, since the upload may already have expired.
+	storer.AbortMultipart(state.ID, state.UploadID)
+
+	return nil, m.uploads.Remove(name)
+}
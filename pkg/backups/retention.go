@@ -0,0 +1,249 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// RetentionPolicy decides which versions of a backup are kept when it is
+// pruned. A version is kept if any rule keeps it. The current version,
+// pinned versions and the versions that a kept incremental version is
+// built on are always kept.
+type RetentionPolicy struct {
+	// KeepLast keeps the most recent versions.
+	KeepLast int `json:"keep_last,omitempty"`
+
+	// KeepHourly, KeepDaily, KeepWeekly, KeepMonthly and KeepYearly keep
+	// the most recent version of each of that many of the most recent
+	// hours, days, weeks, months and years that have a version.
+	KeepHourly  int `json:"keep_hourly,omitempty"`
+	KeepDaily   int `json:"keep_daily,omitempty"`
+	KeepWeekly  int `json:"keep_weekly,omitempty"`
+	KeepMonthly int `json:"keep_monthly,omitempty"`
+	KeepYearly  int `json:"keep_yearly,omitempty"`
+
+	// KeepWithin keeps every version created within this long of pruning.
+	KeepWithin time.Duration `json:"keep_within,omitempty"`
+}
+
+// Validate returns an error if the policy has no rules, which would delete
+// every version but the current version, or has negative rules.
+func (p RetentionPolicy) Validate() error {
+	counts := []int{p.KeepLast, p.KeepHourly, p.KeepDaily, p.KeepWeekly, p.KeepMonthly, p.KeepYearly}
+
+	empty := p.KeepWithin == 0
+	for _, count := range counts {
+		if count < 0 {
+			return errors.New("Retention rules cannot be negative")
+		}
+		if count > 0 {
+			empty = false
+		}
+	}
+
+	if p.KeepWithin < 0 {
+		return errors.New("Retention rules cannot be negative")
+	}
+	if empty {
+		return errors.New("A retention policy must have at least one rule")
+	}
+
+	return nil
+}
+
+// RetentionDecision is the outcome of a retention policy for one version.
+type RetentionDecision struct {
+	Version Version
+	Keep    bool
+
+	// Reasons explains why a kept version is kept. It is empty for versions
+	// that are removed.
+	Reasons []string
+}
+
+// periods are the calendar periods of the bucketed rules, each with a
+// function returning the period a time falls in.
+var periods = []struct {
+	name   string
+	count  func(RetentionPolicy) int
+	period func(time.Time) string
+}{
+	{"hourly", func(p RetentionPolicy) int { return p.KeepHourly }, func(t time.Time) string { return t.Format("2006-01-02 15:00") }},
+	{"daily", func(p RetentionPolicy) int { return p.KeepDaily }, func(t time.Time) string { return t.Format("2006-01-02") }},
+	{"weekly", func(p RetentionPolicy) int { return p.KeepWeekly }, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}},
+	{"monthly", func(p RetentionPolicy) int { return p.KeepMonthly }, func(t time.Time) string { return t.Format("2006-01") }},
+	{"yearly", func(p RetentionPolicy) int { return p.KeepYearly }, func(t time.Time) string { return t.Format("2006") }},
+}
+
+// Apply decides which versions of `lock` the policy keeps when pruning at
+// `now`, whose location is used to divide time into calendar periods. The
+// decisions are ordered from the newest version to the oldest.
+func (p RetentionPolicy) Apply(lock Lock, now time.Time) []RetentionDecision {
+	versions := append([]Version{}, lock.History()...)
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].CreatedAt.After(versions[j].CreatedAt)
+	})
+
+	decisions := make([]RetentionDecision, len(versions))
+	index := make(map[string]int)
+	remaining := make([]int, len(periods))
+	last := make([]string, len(periods))
+	for i := range periods {
+		remaining[i] = periods[i].count(p)
+	}
+
+	for i, version := range versions {
+		decision := RetentionDecision{Version: version}
+		index[version.ID] = i
+
+		if version.ID == lock.Current {
+			decision.Reasons = append(decision.Reasons, "current version")
+		}
+		if version.Pin != nil {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("pinned: %s", version.Pin.Reason))
+		}
+
+		if version.CreatedAt.IsZero() {
+			// Versions recorded without a creation time can't be placed
+			// in time, so no rule can safely decide to remove them.
+			decision.Reasons = append(decision.Reasons, "creation time unknown")
+			decision.Keep = true
+			decisions[i] = decision
+			continue
+		}
+
+		if i < p.KeepLast {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("last %d", p.KeepLast))
+		}
+
+		created := version.CreatedAt.In(now.Location())
+		for j, rule := range periods {
+			period := rule.period(created)
+			if remaining[j] > 0 && period != last[j] {
+				decision.Reasons = append(decision.Reasons, fmt.Sprintf("%s %s", rule.name, period))
+				remaining[j]--
+				last[j] = period
+			}
+		}
+
+		if p.KeepWithin > 0 && !version.CreatedAt.Before(now.Add(-p.KeepWithin)) {
+			decision.Reasons = append(decision.Reasons, fmt.Sprintf("within %s", p.KeepWithin))
+		}
+
+		decision.Keep = len(decision.Reasons) > 0
+		decisions[i] = decision
+	}
+
+	// Incremental versions can only be restored with the versions they are
+	// built on, so those are kept along with them. Parents are older than
+	// their increments, so keeping one is seen before the parent itself.
+	for _, decision := range decisions {
+		if !decision.Keep || decision.Version.Parent == "" {
+			continue
+		}
+
+		if i, ok := index[decision.Version.Parent]; ok {
+			decisions[i].Keep = true
+			decisions[i].Reasons = append(decisions[i].Reasons, fmt.Sprintf("parent of %s", decision.Version.ID))
+		}
+	}
+
+	return decisions
+}
+
+// SetRetention sets the retention policy used to prune `name`. If `policy`
+// is nil, the retention policy is removed and every version is kept.
+func (m Manager) SetRetention(name string, policy *RetentionPolicy) error {
+	if policy != nil {
+		if err := policy.Validate(); err != nil {
+			return err
+		}
+	}
+
+	return m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		lock.Retention = policy
+
+		return lock, nil
+	})
+}
+
+// Retention returns the retention policy of `name`, or nil if it has none.
+func (m Manager) Retention(name string) (*RetentionPolicy, error) {
+	lock, err := m.getExistingLock(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return lock.Retention, nil
+}
+
+// Prune deletes the versions of `name` that its retention policy does not
+// keep, see RetentionPolicy. If `dryRun` is true, nothing is deleted. It
+// returns the decision made for every version, newest first.
+func (m Manager) Prune(name string, dryRun bool) ([]RetentionDecision, error) {
+	if dryRun {
+		lock, err := m.getExistingLock(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return applyRetention(*lock)
+	}
+
+	// As with DeleteVersion, the lock is stored first so that a failure
+	// leaves unreferenced objects behind rather than broken versions.
+	var decisions []RetentionDecision
+	var removed []Version
+	err := m.updateExistingLock(name, func(lock Lock) (Lock, error) {
+		var err error
+		if decisions, err = applyRetention(lock); err != nil {
+			return Lock{}, err
+		}
+
+		removed = nil
+		for _, decision := range decisions {
+			if !decision.Keep {
+				lock = lock.Remove(decision.Version.ID)
+				removed = append(removed, decision.Version)
+			}
+		}
+
+		for _, version := range removed {
+			if err = checkDeletable(lock, version); err != nil {
+				return Lock{}, err
+			}
+		}
+
+		return lock, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var failures []string
+	for _, version := range removed {
+		if err = m.deleteContents(version); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if len(failures) > 0 {
+		return decisions, fmt.Errorf("Some versions could not be deleted: %v", failures)
+	}
+
+	return decisions, nil
+}
+
+// applyRetention applies the retention policy of `lock` at the current time.
+func applyRetention(lock Lock) ([]RetentionDecision, error) {
+	if lock.Retention == nil {
+		return nil, fmt.Errorf("No retention policy is set for %s", lock.Name)
+	}
+
+	return lock.Retention.Apply(lock, time.Now()), nil
+}
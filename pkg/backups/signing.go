@@ -0,0 +1,117 @@
+package backups
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// InvalidSignature is an error returned when a lock's signature is missing or
+// does not match the trusted public key.
+type InvalidSignature struct {
+	Name string
+}
+
+func (e InvalidSignature) Error() string {
+	return fmt.Sprintf("signature verification failed for %s", e.Name)
+}
+
+// Sign returns a copy of the lock signed with `key`.
+func (l Lock) Sign(key ed25519.PrivateKey) (Lock, error) {
+	payload, err := l.signingPayload()
+	if err != nil {
+		return l, err
+	}
+
+	l.Signature = ed25519.Sign(key, payload)
+
+	return l, nil
+}
+
+// Verify checks that the lock was signed by the private key belonging to
+// `key`. An unsigned lock never verifies.
+func (l Lock) Verify(key ed25519.PublicKey) error {
+	if len(l.Signature) == 0 {
+		return InvalidSignature{l.ID()}
+	}
+
+	payload, err := l.signingPayload()
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(key, payload, l.Signature) {
+		return InvalidSignature{l.ID()}
+	}
+
+	return nil
+}
+
+// signingPayload returns the bytes covered by the lock's signature, which is
+// the JSON encoding of the lock without its signature.
+func (l Lock) signingPayload() ([]byte, error) {
+	l.Signature = nil
+
+	return json.Marshal(l)
+}
+
+// LoadPrivateKey reads a PEM encoded PKCS #8 ed25519 private key from `path`,
+// such as one created with `openssl genpkey -algorithm ed25519`.
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if privateKey, ok := key.(ed25519.PrivateKey); ok {
+		return privateKey, nil
+	}
+
+	return nil, fmt.Errorf("%s is not an ed25519 private key", path)
+}
+
+// LoadPublicKey reads a PEM encoded PKIX ed25519 public key from `path`, such
+// as one created with `openssl pkey -pubout`.
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	if publicKey, ok := key.(ed25519.PublicKey); ok {
+		return publicKey, nil
+	}
+
+	return nil, fmt.Errorf("%s is not an ed25519 public key", path)
+}
+
+func readPEM(path string, blockType string) ([]byte, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	if block.Type != blockType {
+		return nil, fmt.Errorf("expected a %s in %s but found a %s", blockType, path, block.Type)
+	}
+
+	return block.Bytes, nil
+}
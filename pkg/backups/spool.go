@@ -0,0 +1,53 @@
+package backups
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spool returns a seekable reader with the contents of `reader`, so they can
+// be read more than once. Readers that can already seek are returned as is,
+// while anything else is copied to a temporary file. The returned function
+// removes the temporary file, if any, and must always be called.
+func spool(reader io.Reader) (io.ReadSeeker, func(), error) {
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		return seeker, func() {}, nil
+	}
+
+	file, err := ioutil.TempFile("", "systools-spool")
+	if err != nil {
+		return nil, func() {}, err
+	}
+	cleanup := func() {
+		file.Close()
+		os.Remove(file.Name())
+	}
+
+	if _, err = io.Copy(file, reader); err != nil {
+		return nil, cleanup, err
+	}
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return nil, cleanup, err
+	}
+
+	return file, cleanup, nil
+}
+
+// checksumSeeker returns the checksum and size of the remaining contents of
+// `seeker` and then seeks back to where it started.
+func checksumSeeker(seeker io.ReadSeeker) (string, int64, error) {
+	start, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", 0, err
+	}
+
+	summer := newSummingReader(seeker)
+	if _, err = io.Copy(ioutil.Discard, summer); err != nil {
+		return "", 0, err
+	}
+
+	_, err = seeker.Seek(start, io.SeekStart)
+
+	return summer.Checksum(), summer.size, err
+}
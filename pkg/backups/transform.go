@@ -0,0 +1,121 @@
+package backups
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+)
+
+// Transformer is a reversible stage that a version's contents pass through
+// between the caller and the backend, such as compression or encryption.
+//
+// The names of the stages a version was encoded with are recorded in its
+// record, so that it can be decoded even after the configured stages change.
+// A Transformer's name must therefore never be reused for a different
+// encoding.
+type Transformer interface {
+	Name() string
+
+	// Encode returns a reader of the encoded contents of `reader`. If the
+	// reader is an io.Closer, it is closed when the backup fails before
+	// reading it in full, which must stop any encoding in progress.
+	Encode(reader io.Reader) (io.Reader, error)
+
+	// Decode returns a reader of the decoded contents of `reader`.
+	Decode(reader io.Reader) (io.Reader, error)
+}
+
+// UnknownTransformer is an error returned when a version was encoded with a
+// Transformer that the Manager does not know of.
+type UnknownTransformer struct {
+	Name string
+}
+
+func (e UnknownTransformer) Error() string {
+	return fmt.Sprintf("unknown transformer %s", e.Name)
+}
+
+// GzipTransformer compresses contents with gzip.
+type GzipTransformer struct{}
+
+// Name returns "gzip".
+func (t GzipTransformer) Name() string {
+	return "gzip"
+}
+
+// Encode compresses the contents of `reader` as they are read.
+func (t GzipTransformer) Encode(reader io.Reader) (io.Reader, error) {
+	return pipeEncoder(reader, func(writer io.Writer) io.WriteCloser {
+		return gzip.NewWriter(writer)
+	}), nil
+}
+
+// Decode decompresses the contents of `reader`.
+func (t GzipTransformer) Decode(reader io.Reader) (io.Reader, error) {
+	return gzip.NewReader(reader)
+}
+
+// pipeEncoder returns a reader of the contents of `reader` as written through
+// the writer created by `encoder`, for encodings only available as writers.
+// Closing the returned reader stops the encoding.
+func pipeEncoder(reader io.Reader, encoder func(io.Writer) io.WriteCloser) io.ReadCloser {
+	pipeReader, pipeWriter := io.Pipe()
+
+	go func() {
+		writer := encoder(pipeWriter)
+		_, err := io.Copy(writer, reader)
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+		pipeWriter.CloseWithError(err)
+	}()
+
+	return pipeReader
+}
+
+// encode passes `reader` through each of the Manager's transformers in order,
+// returning the encoded reader and the names of the applied stages, along
+// with a function that stops the encoding if the encoded reader is not read
+// in full.
+func (m Manager) encode(reader io.Reader) (io.Reader, []string, func(), error) {
+	var names []string
+	var stages []io.Closer
+	abort := func() {
+		for _, stage := range stages {
+			stage.Close()
+		}
+	}
+
+	for _, transformer := range m.transformers {
+		var err error
+		if reader, err = transformer.Encode(reader); err != nil {
+			abort()
+			return nil, nil, nil, err
+		}
+		names = append(names, transformer.Name())
+
+		if closer, ok := reader.(io.Closer); ok {
+			stages = append(stages, closer)
+		}
+	}
+
+	return reader, names, abort, nil
+}
+
+// decode passes `reader` through the inverse of the named stages, in reverse
+// order, returning the reader of the original contents.
+func (m Manager) decode(reader io.Reader, names []string) (io.Reader, error) {
+	for i := len(names) - 1; i >= 0; i-- {
+		transformer, ok := m.knownTransformers[names[i]]
+		if !ok {
+			return nil, UnknownTransformer{names[i]}
+		}
+
+		var err error
+		if reader, err = transformer.Decode(reader); err != nil {
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
@@ -1,6 +1,11 @@
 package backups
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -9,8 +14,30 @@ type Versioner interface {
 	GetVersion() string
 }
 
+// ContentVersioner is a Versioner whose versions are derived from the contents
+// being backed up. Manager.Backup reads the contents in full before storing
+// them to get their version from GetContentVersion rather than GetVersion.
+// Unless the reader can seek, the contents are copied to a temporary file to
+// be read again, which needs as much free disk space as they take up.
+type ContentVersioner interface {
+	Versioner
+
+	GetContentVersion(content ContentInfo) string
+}
+
+// ContentInfo describes the contents of a backup.
+type ContentInfo struct {
+	// Checksum is the hex encoded SHA-256 sum of the contents.
+	Checksum string
+	Size     int64
+}
+
 // TimestampVersioner is a Versioner that returns a timestamp that can be used to
 // version a file. It takes a `time.Time` which it uses to create the version.
+//
+// Its versions have a resolution of one second and are in local time, so
+// versions created in the same second collide. MonotonicVersioner should be
+// used instead.
 type TimestampVersioner struct {
 }
 
@@ -27,6 +54,98 @@ func (v TimestampVersioner) GetVersion() string {
 	return time.Now().Format("20060102T150405")
 }
 
+// monotonicVersionFormat is the format of the time in MonotonicVersioner's
+// versions. It has a fixed width, so versions sort in the order of their
+// times.
+const monotonicVersionFormat = "20060102T150405.000000000Z"
+
+// MonotonicVersioner is a Versioner that returns versions which are unique,
+// sort in the order they were created in and are independent of the local
+// time zone, in the format `YmdTHMS.nnnnnnnnnZ-random`. Each version is a
+// UTC timestamp with nanosecond resolution, which is never earlier than the
+// previous version of the same versioner, followed by random hex digits so
+// that versions created at the same time on different hosts differ.
+type MonotonicVersioner struct {
+	last time.Time
+	mu   sync.Mutex
+}
+
+// NewMonotonicVersioner returns a new MonotonicVersioner.
+func NewMonotonicVersioner() *MonotonicVersioner {
+	return &MonotonicVersioner{}
+}
+
+// GetVersion returns a filename-safe version string, such as
+// `20190815T150000.123456789Z-3f9a1c0b`.
+func (v *MonotonicVersioner) GetVersion() string {
+	v.mu.Lock()
+	now := time.Now().UTC()
+	if !now.After(v.last) {
+		now = v.last.Add(time.Nanosecond)
+	}
+	v.last = now
+	v.mu.Unlock()
+
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		// The timestamp alone is still unique for this versioner.
+		return now.Format(monotonicVersionFormat)
+	}
+
+	return fmt.Sprintf("%s-%s", now.Format(monotonicVersionFormat), hex.EncodeToString(suffix))
+}
+
+// hashVersionLength is the number of hex digits of the checksum used as the
+// version by HashVersioner. The full checksum of each version is recorded,
+// so a backup whose contents only share the prefix of an existing version's
+// checksum fails with VersionExists rather than being mistaken for it.
+const hashVersionLength = 16
+
+// HashVersioner is a ContentVersioner whose versions are the first hex digits
+// of the checksum of the contents, so that identical contents backed up from
+// any host get the same version. Backing up contents identical to an
+// existing version makes that version current instead of storing it again.
+type HashVersioner struct {
+	fallback *MonotonicVersioner
+}
+
+// NewHashVersioner returns a new HashVersioner.
+func NewHashVersioner() HashVersioner {
+	return HashVersioner{fallback: NewMonotonicVersioner()}
+}
+
+// GetVersion returns a MonotonicVersioner version, since there are no
+// contents to derive a version from.
+func (v HashVersioner) GetVersion() string {
+	return v.fallback.GetVersion()
+}
+
+// GetContentVersion returns the first hex digits of the contents' checksum.
+func (v HashVersioner) GetContentVersion(content ContentInfo) string {
+	if len(content.Checksum) < hashVersionLength {
+		return content.Checksum
+	}
+
+	return content.Checksum[:hashVersionLength]
+}
+
+// versionTime returns the time a version of one of the built in versioners was
+// created at, if it can be determined from the version.
+func versionTime(version string) (time.Time, bool) {
+	if i := strings.Index(version, "-"); i != -1 {
+		version = version[:i]
+	}
+
+	if t, err := time.Parse(monotonicVersionFormat, version); err == nil {
+		return t, true
+	}
+	if t, err := time.ParseInLocation("20060102T150405", version, time.Local); err == nil {
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
 type staticVersioner struct {
 	version string
 }
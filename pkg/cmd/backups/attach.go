@@ -11,6 +11,15 @@ func AttachBackupsCommand(rootCmd *cobra.Command) {
 
 	attachBackupCommand(backupsCmd)
 	attachRestoreCommand(backupsCmd)
+	attachListCommand(backupsCmd)
+	attachRollbackCommand(backupsCmd)
+	attachPinCommands(backupsCmd)
+	attachRetentionCommand(backupsCmd)
+	attachPruneCommand(backupsCmd)
+	attachGCCommand(backupsCmd)
+	attachUnlockCommand(backupsCmd)
+	attachMigrateCommand(backupsCmd)
+	attachRepairCommand(backupsCmd)
 
 	rootCmd.AddCommand(backupsCmd)
 }
@@ -1,12 +1,15 @@
 package backups
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/samrap/systools/pkg/backups"
 	"github.com/samrap/systools/pkg/filesystem"
 	"github.com/sirupsen/logrus"
@@ -32,14 +35,34 @@ func attachBackupCommand(rootCmd *cobra.Command) {
 	}
 
 	backupCmd.Flags().StringVarP(&flags.File, "file", "f", "", "The file to backup. Mutually exclusive to -d")
-	backupCmd.Flags().StringVarP(&flags.Directory, "directory", "d", "", "The directory to backup. Will be stored as a gzipped file. Mutually exclusive to -f")
+	backupCmd.Flags().StringVarP(&flags.Directory, "directory", "d", "", "The directory to backup. Will be stored as a tarball. Mutually exclusive to -f")
+	backupCmd.Flags().BoolVar(&flags.Incremental, "incremental", false, "Only archive files of the directory that changed since the last backup")
+	backupCmd.Flags().IntVar(&flags.FullEvery, "full-every", 7, "With --incremental, take a full backup after this many incremental ones")
+	backupCmd.Flags().BoolVar(&flags.SkipUnchanged, "skip-unchanged", false, "Don't create a new version if the contents match the current version. "+
+		"Directories are first written to a temporary tarball, which needs as much free disk space as the tarball takes up")
+	backupCmd.Flags().StringVarP(&flags.Message, "message", "m", "", "Record why the backup was taken, e.g. \"before upgrading postgres 15->16\"")
+	backupCmd.Flags().StringArrayVar(&flags.Tags, "tag", nil, "Label the version with key=value, e.g. release=v4.2. May be given more than once")
+	backupCmd.Flags().BoolVar(&flags.ContentVersions, "content-versions", false, "Name the version after a hash of the contents, so identical contents from any host share a version. "+
+		"Directories are first written to a temporary tarball, which needs as much free disk space as the tarball takes up")
+	backupCmd.Flags().StringSliceVar(&flags.Transforms, "transform", nil, "Encode the backup with these stages in order. Supported: gzip")
+	backupCmd.Flags().BoolVar(&flags.Deduplicate, "dedup", false, "Store the backup as content-defined chunks, uploading only chunks not already stored")
+	backupCmd.Flags().IntVar(&flags.DataShards, "data-shards", 0, "Erasure code the backup into this many data shards across SYSTOOLS_BACKUPS_SHARD_BACKENDS")
+	backupCmd.Flags().IntVar(&flags.ParityShards, "parity-shards", 0, "With --data-shards, the number of parity shards, which is how many shard backends may be lost")
+	attachTransferFlags(backupCmd, &flags.managerFlags)
 
 	rootCmd.AddCommand(backupCmd)
 }
 
 type backupFlags struct {
-	File      string
-	Directory string
+	managerFlags
+
+	File          string
+	Directory     string
+	SkipUnchanged bool
+	Incremental   bool
+	FullEvery     int
+	Message       string
+	Tags          []string
 }
 
 func (bf *backupFlags) Validate() error {
@@ -51,54 +74,193 @@ func (bf *backupFlags) Validate() error {
 		return errors.New("You must specify either a file or directory to back up")
 	}
 
+	if bf.ParityShards > 0 && bf.DataShards == 0 {
+		return errors.New("--parity-shards requires --data-shards")
+	}
+
+	if bf.Incremental && bf.Directory == "" {
+		return errors.New("--incremental may only be used with -d")
+	}
+
 	return nil
 }
 
+// Name returns the file or directory named by the flags.
+func (bf *backupFlags) Name() string {
+	if bf.File != "" {
+		return bf.File
+	}
+
+	return bf.Directory
+}
+
 func runBackupCommand(flags *backupFlags) (string, error) {
-	session := session.Must(session.NewSession(&aws.Config{
-		Endpoint: aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_ENDPOINT")),
-		Region:   aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_REGION")),
-	}))
+	path, err := backups.CanonicalPath(flags.Name())
+	if err != nil {
+		return flags.Name(), err
+	}
 
-	manager := backups.NewManager(
-		backups.NewS3Backend(session, os.Getenv("SYSTOOLS_BACKUPS_S3_BUCKET")),
-		backups.NewTimestampVersioner(),
-	)
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return path, err
+	}
+
+	var options []backups.BackupOption
+	if flags.SkipUnchanged {
+		options = append(options, backups.SkipUnchanged())
+	}
+
+	if flags.Message != "" {
+		options = append(options, backups.WithMessage(flags.Message))
+	}
+
+	if len(flags.Tags) > 0 {
+		labels, err := backups.ParseLabels(flags.Tags)
+		if err != nil {
+			return path, err
+		}
+		options = append(options, backups.WithLabels(labels))
+	}
 
 	if flags.File != "" {
-		logrus.Infof("Backing up file %s", flags.File)
+		logrus.Infof("Backing up file %s", path)
 
-		return flags.File, backupFile(flags.File, manager)
+		return path, backupFile(path, manager, options...)
 	}
 
-	logrus.Infof("Backing up directory: %s", flags.Directory)
+	logrus.Infof("Backing up directory: %s", path)
 
-	return flags.Directory, backupDirectory(flags.Directory, manager)
+	if flags.Incremental {
+		return path, backupDirectoryIncremental(path, flags.FullEvery, manager, options...)
+	}
+
+	return path, backupDirectory(path, manager, options...)
 }
 
-func backupFile(filename string, manager backups.Manager) error {
+func backupFile(filename string, manager backups.Manager, options ...backups.BackupOption) error {
 	reader, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer reader.Close()
+
+	// Identify the file by its contents' path, size and modification time, so
+	// that an interrupted upload of the same file can be resumed.
+	info, err := reader.Stat()
+	if err != nil {
+		return err
+	}
+	abspath, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	source := fmt.Sprintf("%s:%d:%d", abspath, info.Size(), info.ModTime().UnixNano())
+	options = append(options, backups.WithSource(source), backups.WithMetadata(backups.NewFileMetadata(abspath, info)))
 
-	return manager.Backup(filename, reader)
+	return manager.Backup(filename, reader, options...)
 }
 
-func backupDirectory(dirname string, manager backups.Manager) error {
-	logrus.Info("Creating tarball")
+func backupDirectory(dirname string, manager backups.Manager, options ...backups.BackupOption) error {
+	logrus.Info("Streaming tarball to back end")
+
+	reader := streamTarball(dirname, nil)
+	defer reader.Close()
 
-	tarpath, err := filesystem.CreateTarball(dirname, os.TempDir())
+	return manager.Backup(dirname, reader, options...)
+}
+
+// streamTarball returns a reader of a tarball of `dirname` which is created as
+// it is read, so that it never has to be stored in full. Read returns any
+// error encountered while creating the tarball.
+func streamTarball(dirname string, include map[string]bool) *io.PipeReader {
+	reader, writer := io.Pipe()
+
+	go func() {
+		err := filesystem.WritePartialTarball(dirname, writer, include)
+		if err != nil {
+			err = fmt.Errorf("Unable to create tarball for directory %s: %v", dirname, err)
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+// backupDirectoryIncremental backs up only the files of `dirname` that changed
+// since the current version, as recorded in its file manifest. A full backup
+// is taken instead if there is no manifest to compare against or the chain
+// of incremental backups has reached `fullEvery` versions.
+func backupDirectoryIncremental(dirname string, fullEvery int, manager backups.Manager, options ...backups.BackupOption) error {
+	current, err := manager.Current(dirname)
+	if err != nil {
+		return err
+	}
+
+	var previous *filesystem.Manifest
+	if current != nil && current.Manifest != "" {
+		chain, err := manager.Chain(dirname)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := readManifest(*current, manager)
+		if err != nil {
+			return err
+		}
+		previous = &manifest
+
+		if len(chain) > fullEvery {
+			logrus.Infof("Reached %d incremental backups, taking a full backup", len(chain)-1)
+			current = nil
+		}
+	}
+
+	logrus.Info("Building file manifest")
+
+	manifest, err := filesystem.BuildManifest(dirname, previous)
+	if err != nil {
+		return fmt.Errorf("Unable to build manifest for directory %s: %v", dirname, err)
+	}
+
+	// Without a current version with a manifest, all files are included.
+	var include map[string]bool
+	if current != nil && previous != nil {
+		var changed []string
+		changed, manifest.Deleted = manifest.Changes(*previous)
+
+		include = make(map[string]bool)
+		for _, name := range changed {
+			include[name] = true
+		}
+		options = append(options, backups.WithParent(current.ID))
+
+		logrus.Infof("Streaming incremental tarball of %d changed and %d deleted files", len(changed), len(manifest.Deleted))
+	} else {
+		logrus.Info("Streaming full tarball")
+	}
+
+	manifestBytes, err := json.Marshal(manifest)
 	if err != nil {
-		return fmt.Errorf("Unable to create tarball for directory %s: %v", dirname, err)
+		return err
 	}
+	options = append(options, backups.WithManifest(bytes.NewReader(manifestBytes)))
 
-	reader, err := os.Open(tarpath)
+	reader := streamTarball(dirname, include)
+	defer reader.Close()
+
+	return manager.Backup(dirname, reader, options...)
+}
+
+func readManifest(version backups.Version, manager backups.Manager) (filesystem.Manifest, error) {
+	reader, err := manager.ReadManifest(version)
 	if err != nil {
-		return fmt.Errorf("Unable to open tarball for reading: %v", err)
+		return filesystem.Manifest{}, err
 	}
 
-	logrus.Info("Tarball created. Uploading back up")
+	manifestBytes, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return filesystem.Manifest{}, err
+	}
 
-	return manager.Backup(dirname, reader)
+	return filesystem.NewManifestFromBytes(manifestBytes)
 }
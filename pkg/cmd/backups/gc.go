@@ -0,0 +1,82 @@
+package backups
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachGCCommand(rootCmd *cobra.Command) {
+	var flags = &gcFlags{}
+	var gcCmd = &cobra.Command{
+		Use:   "gc",
+		Short: "Delete stored objects that no backup refers to",
+		Long: "Delete the version contents, manifests, chunks and shards that no backup refers to, " +
+			"such as those left behind by failed backups. Objects modified within the grace period are kept, " +
+			"so that backups in progress are not affected, and chunks are kept while any backup is running.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runGCCommand(flags); err != nil {
+				logrus.Fatalf("Failed to collect garbage: %v", err)
+			}
+		},
+	}
+
+	gcCmd.Flags().StringVar(&flags.GracePeriod, "grace-period", "24h", "Keep objects modified within this long, e.g. \"36h\" or \"2d\"")
+	gcCmd.Flags().BoolVar(&flags.DryRun, "dry-run", false, "Show what would be deleted without deleting anything")
+	gcCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "Collect garbage even if the signatures of backups cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(gcCmd)
+}
+
+type gcFlags struct {
+	managerFlags
+
+	GracePeriod string
+	DryRun      bool
+}
+
+func runGCCommand(flags *gcFlags) error {
+	grace, err := parseDuration(flags.GracePeriod)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	orphans, err := manager.GC(grace, flags.DryRun)
+	if orphans == nil {
+		if err == nil {
+			logrus.Info("No orphaned objects were found")
+		}
+		return err
+	}
+
+	action := "deleted"
+	if flags.DryRun {
+		action = "delete"
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACTION\tBACKEND\tNAME\tSIZE\tMODIFIED")
+	for _, orphan := range orphans {
+		backend := orphan.Backend
+		if backend == "" {
+			backend = "-"
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%s\n", action, backend, orphan.Name, orphan.Size, orphan.LastModified.Local().Format(time.RFC3339))
+	}
+	if flushErr := writer.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+
+	return err
+}
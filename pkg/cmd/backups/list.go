@@ -0,0 +1,160 @@
+package backups
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachListCommand(rootCmd *cobra.Command) {
+	var flags = &listFlags{}
+	var listCmd = &cobra.Command{
+		Use:   "list <file or directory>",
+		Short: "List every version of a backed up file or directory",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runListCommand(args[0], flags); err != nil {
+				logrus.Fatalf("Failed to list versions of %s: %v", args[0], err)
+			}
+		},
+	}
+
+	listCmd.Flags().BoolVar(&flags.Log, "log", false, "Show the full message, author and systools version of each version, newest first, like git log")
+	listCmd.Flags().StringArrayVar(&flags.Tags, "tag", nil, "Only list versions labeled key=value, or with key, !key or key!=value. May be given more than once")
+	listCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "List versions even if the backup's signature cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(listCmd)
+}
+
+type listFlags struct {
+	managerFlags
+
+	Log  bool
+	Tags []string
+}
+
+func runListCommand(path string, flags *listFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	selector, err := backups.ParseSelector(flags.Tags)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	versions, err := manager.Select(name, selector)
+	if err != nil {
+		return err
+	}
+
+	current, err := manager.Current(name)
+	if err != nil {
+		return err
+	}
+
+	if flags.Log {
+		for i := len(versions) - 1; i >= 0; i-- {
+			writeLogEntry(os.Stdout, versions[i], current != nil && versions[i].ID == current.ID)
+		}
+		return nil
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "\tVERSION\tCREATED\tSIZE\tCHECKSUM\tHOST\tPINNED\tLABELS\tMESSAGE")
+	for _, version := range versions {
+		fmt.Fprintln(writer, formatVersion(version, current != nil && version.ID == current.ID))
+	}
+
+	return writer.Flush()
+}
+
+// formatVersion formats a version as a tab separated row of `list` output,
+// marking the current version with an asterisk.
+func formatVersion(version backups.Version, current bool) string {
+	marker := ""
+	if current {
+		marker = "*"
+	}
+
+	created := "-"
+	if !version.CreatedAt.IsZero() {
+		created = version.CreatedAt.Local().Format(time.RFC3339)
+	}
+
+	checksum := "-"
+	if len(version.Checksum) >= 12 {
+		checksum = version.Checksum[:12]
+	}
+
+	host := version.Host
+	if host == "" {
+		host = "-"
+	}
+
+	pinned := "-"
+	if version.Pin != nil {
+		pinned = version.Pin.Reason
+	}
+
+	labels := "-"
+	if len(version.Labels) > 0 {
+		labels = version.Labels.String()
+	}
+
+	message := "-"
+	if version.Message != "" {
+		message = strings.SplitN(version.Message, "\n", 2)[0]
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s", marker, backups.ShortVersion(version.ID), created, version.Size, checksum, host, pinned, labels, message)
+}
+
+// writeLogEntry writes a version as an entry of `list --log` output, in the
+// style of git log.
+func writeLogEntry(writer io.Writer, version backups.Version, current bool) {
+	marker := ""
+	if current {
+		marker = " (current)"
+	}
+	fmt.Fprintf(writer, "version %s%s\n", backups.ShortVersion(version.ID), marker)
+
+	if version.Author != "" {
+		fmt.Fprintf(writer, "Author:   %s\n", version.Author)
+	} else if version.Host != "" {
+		fmt.Fprintf(writer, "Host:     %s\n", version.Host)
+	}
+	if !version.CreatedAt.IsZero() {
+		fmt.Fprintf(writer, "Date:     %s\n", version.CreatedAt.Local().Format(time.RFC1123Z))
+	}
+	if version.SystoolsVersion != "" {
+		fmt.Fprintf(writer, "Systools: %s\n", version.SystoolsVersion)
+	}
+	if len(version.Labels) > 0 {
+		fmt.Fprintf(writer, "Labels:   %s\n", version.Labels)
+	}
+	if version.Pin != nil {
+		fmt.Fprintf(writer, "Pinned:   %s\n", version.Pin.Reason)
+	}
+
+	fmt.Fprintln(writer)
+	if version.Message != "" {
+		for _, line := range strings.Split(version.Message, "\n") {
+			fmt.Fprintf(writer, "    %s\n", line)
+		}
+		fmt.Fprintln(writer)
+	}
+}
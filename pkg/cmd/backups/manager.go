@@ -0,0 +1,157 @@
+package backups
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// managerFlags are flags shared by every command that needs a Manager.
+type managerFlags struct {
+	SkipVerify   bool
+	Deduplicate  bool
+	Concurrency  int
+	PartSize     int64
+	DataShards   int
+	ParityShards int
+	Transforms   []string
+
+	// ContentVersions derives version IDs from a hash of the contents.
+	ContentVersions bool
+}
+
+// transformers are the Transformers that can be selected with --transform.
+var transformers = map[string]backups.Transformer{
+	backups.GzipTransformer{}.Name(): backups.GzipTransformer{},
+}
+
+// attachTransferFlags attaches the flags controlling how versions are
+// transferred to and from the back end.
+func attachTransferFlags(cmd *cobra.Command, flags *managerFlags) {
+	cmd.Flags().IntVar(&flags.Concurrency, "concurrency", 1, "The number of parts of a large backup to transfer at once")
+	cmd.Flags().Int64Var(&flags.PartSize, "part-size", backups.DefaultPartSize/1024/1024, "The size in MiB of each part transferred when --concurrency is greater than 1")
+}
+
+// newManager returns a Manager configured from the environment.
+//
+// If SYSTOOLS_BACKUPS_SIGNING_KEY is set to the path of an ed25519 private
+// key, every lock written is signed with it. If SYSTOOLS_BACKUPS_VERIFY_KEY
+// is set to the path of an ed25519 public key, every lock read must be
+// signed by its private key unless verification is explicitly skipped.
+//
+// SYSTOOLS_BACKUPS_SHARD_BACKENDS lists the S3 buckets that shards of erasure
+// coded backups are stored on, separated by commas. Each bucket may be
+// followed by "@" and the endpoint of a different S3-compatible provider.
+//
+// If SYSTOOLS_BACKUPS_S3_UNCONDITIONAL_WRITES is set to "true", locks and
+// leases are stored without conditional writes, for providers that don't
+// support them. Backups of the same file must then never run concurrently.
+func newManager(flags managerFlags) (backups.Manager, error) {
+	session := session.Must(session.NewSession(&aws.Config{
+		Endpoint: aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_ENDPOINT")),
+		Region:   aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_REGION")),
+	}))
+
+	var options []backups.Option
+
+	if path := os.Getenv("SYSTOOLS_BACKUPS_SIGNING_KEY"); path != "" {
+		key, err := backups.LoadPrivateKey(path)
+		if err != nil {
+			return backups.Manager{}, fmt.Errorf("Unable to load signing key: %v", err)
+		}
+		options = append(options, backups.WithSigningKey(key))
+	}
+
+	if flags.SkipVerify {
+		logrus.Warn("SIGNATURE VERIFICATION IS DISABLED. Backups will be used even if they have been tampered with!")
+	} else if path := os.Getenv("SYSTOOLS_BACKUPS_VERIFY_KEY"); path != "" {
+		key, err := backups.LoadPublicKey(path)
+		if err != nil {
+			return backups.Manager{}, fmt.Errorf("Unable to load verify key: %v", err)
+		}
+		options = append(options, backups.WithVerifyKey(key))
+	}
+
+	// Unfinished uploads are resumable as long as there is somewhere to keep
+	// their state between runs.
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		store := backups.NewUploadStateStore(filepath.Join(cacheDir, "systools", "uploads"))
+		options = append(options, backups.WithResumableUploads(store))
+	} else {
+		logrus.Debugf("Uploads will not be resumable: %v", err)
+	}
+
+	if flags.Concurrency > 1 {
+		options = append(options, backups.WithConcurrency(flags.Concurrency, flags.PartSize*1024*1024))
+	}
+
+	if shardBackends := os.Getenv("SYSTOOLS_BACKUPS_SHARD_BACKENDS"); shardBackends != "" {
+		options = append(options, backups.WithShardBackends(newShardBackends(shardBackends)...))
+	}
+
+	if flags.DataShards > 0 {
+		options = append(options, backups.WithErasureCoding(flags.DataShards, flags.ParityShards))
+	}
+
+	if flags.Deduplicate {
+		options = append(options, backups.WithDeduplication())
+	}
+
+	if len(flags.Transforms) > 0 {
+		var stages []backups.Transformer
+		for _, name := range flags.Transforms {
+			transformer, ok := transformers[name]
+			if !ok {
+				return backups.Manager{}, fmt.Errorf("Unknown transform %s", name)
+			}
+			stages = append(stages, transformer)
+		}
+		options = append(options, backups.WithTransformers(stages...))
+	}
+
+	var versioner backups.Versioner = backups.NewMonotonicVersioner()
+	if flags.ContentVersions {
+		versioner = backups.NewHashVersioner()
+	}
+
+	backend := backups.NewS3Backend(session, os.Getenv("SYSTOOLS_BACKUPS_S3_BUCKET"))
+	if os.Getenv("SYSTOOLS_BACKUPS_S3_UNCONDITIONAL_WRITES") == "true" {
+		logrus.Warn("CONDITIONAL WRITES ARE DISABLED. Concurrent backups of the same file may overwrite each other's changes!")
+		backend = backend.WithoutConditionalWrites()
+	}
+
+	return backups.NewManager(backend, versioner, options...), nil
+}
+
+// newShardBackends returns an S3 backend for each comma separated bucket in
+// `buckets`, in the format "bucket" or "bucket@endpoint".
+func newShardBackends(buckets string) []backups.ShardBackend {
+	var shardBackends []backups.ShardBackend
+
+	for _, name := range strings.Split(buckets, ",") {
+		name = strings.TrimSpace(name)
+		bucket, endpoint := name, os.Getenv("SYSTOOLS_BACKUPS_S3_ENDPOINT")
+		if i := strings.Index(name, "@"); i != -1 {
+			bucket, endpoint = name[:i], name[i+1:]
+		}
+
+		session := session.Must(session.NewSession(&aws.Config{
+			Endpoint: aws.String(endpoint),
+			Region:   aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_REGION")),
+		}))
+
+		shardBackends = append(shardBackends, backups.ShardBackend{
+			Name:    name,
+			Backend: backups.NewS3Backend(session, bucket),
+		})
+	}
+
+	return shardBackends
+}
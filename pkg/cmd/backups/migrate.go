@@ -0,0 +1,70 @@
+package backups
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachMigrateCommand(rootCmd *cobra.Command) {
+	var flags = &migrateFlags{}
+	var migrateCmd = &cobra.Command{
+		Use:   "migrate",
+		Short: "Upgrade every backup to the current format and key layout",
+		Long: "Upgrade the locks of every backup written by an earlier version of systools to the current format, " +
+			"and move them to the current key layout. Backups named by relative paths are renamed to the absolute path " +
+			"they were backed up from, or reported if it is unknown. Backups that are already up to date are left untouched, " +
+			"so it is safe to run more than once.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runMigrateCommand(flags); err != nil {
+				logrus.Fatalf("Failed to migrate backups: %v", err)
+			}
+		},
+	}
+
+	migrateCmd.Flags().BoolVar(&flags.DryRun, "dry-run", false, "Show which backups would be migrated without changing them")
+	migrateCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "Migrate even if the signatures of backups cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(migrateCmd)
+}
+
+type migrateFlags struct {
+	managerFlags
+
+	DryRun bool
+}
+
+func runMigrateCommand(flags *migrateFlags) error {
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := manager.Migrate(flags.DryRun)
+
+	upgrade, move, rename := "Upgraded", "Moved", "Renamed"
+	if flags.DryRun {
+		upgrade, move, rename = "Would upgrade", "Would move", "Would rename"
+	}
+	for _, migration := range migrations {
+		if migration.From != migration.To {
+			logrus.Infof("%s %s from format %d to %d", upgrade, migration.Name, migration.From, migration.To)
+		}
+		if migration.Moved {
+			logrus.Infof("%s %s to the current key layout", move, migration.Name)
+		}
+		if migration.Canonical != "" {
+			logrus.Infof("%s %s to %s", rename, migration.Name, migration.Canonical)
+		}
+		if migration.Unresolved != "" {
+			logrus.Warnf("%s is not an absolute path, so it can't be restored by name, and was not renamed: %s",
+				migration.Name, migration.Unresolved)
+		}
+	}
+
+	if err == nil && len(migrations) == 0 {
+		logrus.Info("Every backup is up to date")
+	}
+
+	return err
+}
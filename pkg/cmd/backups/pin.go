@@ -0,0 +1,103 @@
+package backups
+
+import (
+	"errors"
+
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachPinCommands(rootCmd *cobra.Command) {
+	var pinFlags = &pinFlags{}
+	var pinCmd = &cobra.Command{
+		Use:   "pin <file or directory> <version>",
+		Short: "Keep a version of a backup forever, so that it is never deleted",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := pinFlags.Validate(); err != nil {
+				logrus.Fatal(err)
+			}
+
+			if err := runPinCommand(args[0], args[1], pinFlags); err != nil {
+				logrus.Fatalf("Failed to pin %s: %v", args[0], err)
+			}
+		},
+	}
+
+	pinCmd.Flags().StringVarP(&pinFlags.Reason, "reason", "r", "", "Why the version must be kept")
+	pinCmd.Flags().BoolVar(&pinFlags.SkipVerify, "skip-verify", false, "Pin even if the backup's signature cannot be verified. Dangerous!")
+
+	var unpinFlags = &managerFlags{}
+	var unpinCmd = &cobra.Command{
+		Use:   "unpin <file or directory> <version>",
+		Short: "Allow a pinned version of a backup to be deleted again",
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runUnpinCommand(args[0], args[1], unpinFlags); err != nil {
+				logrus.Fatalf("Failed to unpin %s: %v", args[0], err)
+			}
+		},
+	}
+
+	unpinCmd.Flags().BoolVar(&unpinFlags.SkipVerify, "skip-verify", false, "Unpin even if the backup's signature cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(pinCmd)
+	rootCmd.AddCommand(unpinCmd)
+}
+
+type pinFlags struct {
+	managerFlags
+
+	Reason string
+}
+
+func (pf *pinFlags) Validate() error {
+	if pf.Reason == "" {
+		return errors.New("You must give a reason for pinning the version with --reason")
+	}
+
+	return nil
+}
+
+func runPinCommand(path string, id string, flags *pinFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	version, err := manager.Pin(name, id, flags.Reason)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Pinned version %s of %s", backups.ShortVersion(version.ID), name)
+
+	return nil
+}
+
+func runUnpinCommand(path string, id string, flags *managerFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(*flags)
+	if err != nil {
+		return err
+	}
+
+	version, err := manager.Unpin(name, id)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Unpinned version %s of %s", backups.ShortVersion(version.ID), name)
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package backups
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachRetentionCommand(rootCmd *cobra.Command) {
+	var flags = &retentionFlags{}
+	var retentionCmd = &cobra.Command{
+		Use:   "retention <file or directory>",
+		Short: "Show or set the retention policy used to prune a backup",
+		Long: "Show or set the retention policy used to prune a backup. A version is kept if any rule keeps it. " +
+			"The current version, pinned versions and the versions an incremental version is built on are always kept.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRetentionCommand(args[0], cmd, flags); err != nil {
+				logrus.Fatalf("Failed to set the retention policy of %s: %v", args[0], err)
+			}
+		},
+	}
+
+	retentionCmd.Flags().IntVar(&flags.Policy.KeepLast, "keep-last", 0, "Keep the most recent N versions")
+	retentionCmd.Flags().IntVar(&flags.Policy.KeepHourly, "keep-hourly", 0, "Keep the last version of each of the last N hours with a version")
+	retentionCmd.Flags().IntVar(&flags.Policy.KeepDaily, "keep-daily", 0, "Keep the last version of each of the last N days with a version")
+	retentionCmd.Flags().IntVar(&flags.Policy.KeepWeekly, "keep-weekly", 0, "Keep the last version of each of the last N weeks with a version")
+	retentionCmd.Flags().IntVar(&flags.Policy.KeepMonthly, "keep-monthly", 0, "Keep the last version of each of the last N months with a version")
+	retentionCmd.Flags().IntVar(&flags.Policy.KeepYearly, "keep-yearly", 0, "Keep the last version of each of the last N years with a version")
+	retentionCmd.Flags().StringVar(&flags.KeepWithin, "keep-within", "", "Keep every version created within this long, e.g. \"36h\", \"30d\" or \"2w\"")
+	retentionCmd.Flags().BoolVar(&flags.Clear, "clear", false, "Remove the retention policy, so that every version is kept")
+	retentionCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "Use the backup even if its signature cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(retentionCmd)
+}
+
+type retentionFlags struct {
+	managerFlags
+
+	Policy     backups.RetentionPolicy
+	KeepWithin string
+	Clear      bool
+}
+
+func runRetentionCommand(path string, cmd *cobra.Command, flags *retentionFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	changed := false
+	for _, flag := range []string{"keep-last", "keep-hourly", "keep-daily", "keep-weekly", "keep-monthly", "keep-yearly", "keep-within"} {
+		changed = changed || cmd.Flags().Changed(flag)
+	}
+
+	if changed && flags.Clear {
+		return errors.New("--clear cannot be combined with retention rules")
+	}
+
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	if flags.Clear {
+		if err = manager.SetRetention(name, nil); err != nil {
+			return err
+		}
+		logrus.Infof("Removed the retention policy of %s", name)
+
+		return nil
+	}
+
+	if !changed {
+		policy, err := manager.Retention(name)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(formatPolicy(policy))
+
+		return nil
+	}
+
+	if flags.KeepWithin != "" {
+		if flags.Policy.KeepWithin, err = parseDuration(flags.KeepWithin); err != nil {
+			return err
+		}
+	}
+
+	if err = manager.SetRetention(name, &flags.Policy); err != nil {
+		return err
+	}
+
+	logrus.Infof("Set the retention policy of %s to %s", name, formatPolicy(&flags.Policy))
+
+	return nil
+}
+
+// formatPolicy formats the rules of a retention policy like the flags used
+// to set them.
+func formatPolicy(policy *backups.RetentionPolicy) string {
+	if policy == nil {
+		return "keep every version"
+	}
+
+	var rules []string
+	for _, rule := range []struct {
+		flag  string
+		count int
+	}{
+		{"keep-last", policy.KeepLast},
+		{"keep-hourly", policy.KeepHourly},
+		{"keep-daily", policy.KeepDaily},
+		{"keep-weekly", policy.KeepWeekly},
+		{"keep-monthly", policy.KeepMonthly},
+		{"keep-yearly", policy.KeepYearly},
+	} {
+		if rule.count > 0 {
+			rules = append(rules, fmt.Sprintf("--%s %d", rule.flag, rule.count))
+		}
+	}
+
+	if policy.KeepWithin > 0 {
+		rules = append(rules, fmt.Sprintf("--keep-within %s", policy.KeepWithin))
+	}
+
+	return strings.Join(rules, " ")
+}
+
+func attachPruneCommand(rootCmd *cobra.Command) {
+	var flags = &pruneFlags{}
+	var pruneCmd = &cobra.Command{
+		Use:   "prune <file or directory>",
+		Short: "Delete the versions of a backup that its retention policy does not keep",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runPruneCommand(args[0], flags); err != nil {
+				logrus.Fatalf("Failed to prune %s: %v", args[0], err)
+			}
+		},
+	}
+
+	pruneCmd.Flags().BoolVar(&flags.DryRun, "dry-run", false, "Show what would be removed and why each version is kept, without deleting anything")
+	pruneCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "Prune even if the backup's signature cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(pruneCmd)
+}
+
+type pruneFlags struct {
+	managerFlags
+
+	DryRun bool
+}
+
+func runPruneCommand(path string, flags *pruneFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	decisions, err := manager.Prune(name, flags.DryRun)
+	if decisions == nil {
+		return err
+	}
+
+	removed := "remove"
+	if !flags.DryRun {
+		removed = "removed"
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ACTION\tVERSION\tCREATED\tREASON")
+	for _, decision := range decisions {
+		action, reason := "keep", strings.Join(decision.Reasons, ", ")
+		if !decision.Keep {
+			action, reason = removed, "not kept by any rule"
+		}
+
+		created := "-"
+		if !decision.Version.CreatedAt.IsZero() {
+			created = decision.Version.CreatedAt.Local().Format(time.RFC3339)
+		}
+
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%s\n", action, backups.ShortVersion(decision.Version.ID), created, reason)
+	}
+	if flushErr := writer.Flush(); flushErr != nil && err == nil {
+		err = flushErr
+	}
+
+	return err
+}
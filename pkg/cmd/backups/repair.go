@@ -0,0 +1,62 @@
+package backups
+
+import (
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachRepairCommand(rootCmd *cobra.Command) {
+	var flags = &repairFlags{}
+	var repairCmd = &cobra.Command{
+		Use:   "repair",
+		Short: "Rebuild missing or corrupt locks from the stored versions",
+		Long: "Scan the back end for stored versions and rebuild the lock of every backup whose lock is missing or corrupt, " +
+			"with the newest version as the current version. Problems that could not be resolved are reported.",
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runRepairCommand(flags); err != nil {
+				logrus.Fatalf("Failed to repair backups: %v", err)
+			}
+		},
+	}
+
+	repairCmd.Flags().BoolVar(&flags.DryRun, "dry-run", false, "Show which locks would be rebuilt without storing them")
+
+	rootCmd.AddCommand(repairCmd)
+}
+
+type repairFlags struct {
+	managerFlags
+
+	DryRun bool
+}
+
+func runRepairCommand(flags *repairFlags) error {
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return err
+	}
+
+	repairs, err := manager.Repair(flags.DryRun)
+
+	action := "Rebuilt"
+	if flags.DryRun {
+		action = "Would rebuild"
+	}
+	for _, repair := range repairs {
+		if repair.Rebuilt {
+			current := repair.Versions[len(repair.Versions)-1]
+			logrus.Infof("%s the lock of %s from %d versions, the current version is %s", action, repair.Name, len(repair.Versions), backups.ShortVersion(current.ID))
+		}
+		for _, problem := range repair.Problems {
+			logrus.Warnf("%s: %s", repair.Name, problem)
+		}
+	}
+
+	if err == nil && len(repairs) == 0 {
+		logrus.Info("Every backup is consistent")
+	}
+
+	return err
+}
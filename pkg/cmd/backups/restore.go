@@ -3,12 +3,13 @@ package backups
 import (
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/samrap/systools/pkg/backups"
 	"github.com/samrap/systools/pkg/filesystem"
 	"github.com/sirupsen/logrus"
@@ -34,14 +35,28 @@ func attachRestoreCommand(rootCmd *cobra.Command) {
 	}
 
 	restoreCmd.Flags().StringVarP(&flags.File, "file", "f", "", "The file to restore. Mutually exclusive to -d")
-	restoreCmd.Flags().StringVarP(&flags.Directory, "directory", "d", "", "The directory to restore. Mutually exclusive to -f")
+	restoreCmd.Flags().StringVarP(&flags.Directory, "directory", "d", "", "The directory to restore. Mutually exclusive to -f. "+
+		"Each version is verified before it is extracted, which needs room for it in the temporary directory")
+	restoreCmd.Flags().StringVar(&flags.Version, "version", "", "Restore this version instead of the current version")
+	restoreCmd.Flags().StringVar(&flags.At, "at", "", "Restore the newest version at or before this time, e.g. \"2026-10-01 03:00\" or \"2 days ago\"")
+	restoreCmd.Flags().StringArrayVar(&flags.Tags, "tag", nil, "Restore the newest version labeled key=value, or with key, !key or key!=value. May be given more than once")
+	restoreCmd.Flags().BoolVar(&flags.SkipOwnership, "skip-ownership", false, "Don't restore the owner of a file, which requires root")
+	restoreCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "Restore even if the backup's signature cannot be verified. Dangerous!")
+	attachTransferFlags(restoreCmd, &flags.managerFlags)
 
 	rootCmd.AddCommand(restoreCmd)
 }
 
 type restoreFlags struct {
+	managerFlags
+
 	File      string
 	Directory string
+	Version   string
+	At        string
+	Tags      []string
+
+	SkipOwnership bool
 }
 
 func (rf *restoreFlags) Validate() error {
@@ -53,54 +68,247 @@ func (rf *restoreFlags) Validate() error {
 		return errors.New("You must specify either a file or directory to restore")
 	}
 
+	selections := 0
+	for _, selected := range []bool{rf.Version != "", rf.At != "", len(rf.Tags) > 0} {
+		if selected {
+			selections++
+		}
+	}
+	if selections > 1 {
+		return errors.New("Only one of --version, --at or --tag is allowed")
+	}
+
 	return nil
 }
 
+// Name returns the file or directory named by the flags.
+func (rf *restoreFlags) Name() string {
+	if rf.File != "" {
+		return rf.File
+	}
+
+	return rf.Directory
+}
+
 func runRestoreCommand(flags *restoreFlags) (string, error) {
-	session := session.Must(session.NewSession(&aws.Config{
-		Endpoint: aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_ENDPOINT")),
-		Region:   aws.String(os.Getenv("SYSTOOLS_BACKUPS_S3_REGION")),
-	}))
+	path, err := backups.CanonicalPath(flags.Name())
+	if err != nil {
+		return flags.Name(), err
+	}
 
-	manager := backups.NewManager(
-		backups.NewS3Backend(session, os.Getenv("SYSTOOLS_BACKUPS_S3_BUCKET")),
-		backups.NewTimestampVersioner(),
-	)
+	manager, err := newManager(flags.managerFlags)
+	if err != nil {
+		return path, err
+	}
+
+	version, err := selectVersion(path, flags, manager)
+	if err != nil {
+		return path, err
+	}
 
 	if flags.File != "" {
-		logrus.Infof("Restoring file %s", flags.File)
+		logrus.Infof("Restoring file %s", path)
+
+		return path, restoreFile(path, version, flags.SkipOwnership, manager)
+	}
+
+	logrus.Infof("Restoring directory: %s", path)
+
+	return path, restoreDirectory(path, version, manager)
+}
+
+// selectVersion returns the ID of the version of `name` selected by --version,
+// --at or --tag, or an empty string to restore the current version.
+func selectVersion(name string, flags *restoreFlags, manager backups.Manager) (string, error) {
+	if flags.Version != "" {
+		version, err := manager.Version(name, flags.Version)
+		if err != nil {
+			return "", err
+		}
+
+		return version.ID, nil
+	}
+
+	if flags.At != "" {
+		at, err := parseTime(flags.At, time.Now())
+		if err != nil {
+			return "", err
+		}
+
+		version, err := manager.VersionAt(name, at)
+		if err != nil {
+			return "", err
+		}
+
+		logrus.Infof("Selected version %s created at %s", backups.ShortVersion(version.ID), version.CreatedAt.Local().Format(time.RFC3339))
+
+		return version.ID, nil
+	}
+
+	if len(flags.Tags) > 0 {
+		selector, err := backups.ParseSelector(flags.Tags)
+		if err != nil {
+			return "", err
+		}
+
+		version, err := manager.Latest(name, selector)
+		if err != nil {
+			return "", err
+		}
+
+		logrus.Infof("Selected version %s labeled %s", backups.ShortVersion(version.ID), version.Labels)
+
+		return version.ID, nil
+	}
+
+	return "", nil
+}
+
+// restoreFile restores version `version` of `filename`, or the current
+// version if `version` is empty.
+//
+// The file's mode, modification time and, unless `skipOwnership` is true, its
+// owner are restored from the version's metadata if it has any.
+func restoreFile(filename string, version string, skipOwnership bool, manager backups.Manager) error {
+	var record *backups.Version
+	var err error
+	if version == "" {
+		record, err = manager.Current(filename)
+	} else {
+		var found backups.Version
+		found, err = manager.Version(filename, version)
+		record = &found
+	}
+	if err != nil {
+		return err
+	}
+	if record == nil {
+		return fmt.Errorf("No backup exists for file %s", filename)
+	}
 
-		return flags.File, restoreFile(flags.File, manager)
+	reader, err := manager.RestoreVersion(filename, record.ID)
+	if err != nil {
+		return err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
 	}
 
-	logrus.Infof("Restoring directory: %s", flags.Directory)
+	metadata := record.Metadata
+	if metadata == nil {
+		// Versions backed up without metadata keep the previous behavior.
+		return writeFile(filename, reader, 0)
+	}
 
-	return flags.Directory, restoreDirectory(flags.Directory, manager)
+	if abspath, err := filepath.Abs(filename); err == nil && abspath != metadata.Path {
+		logrus.Infof("%s was backed up from %s", filename, metadata.Path)
+	}
+
+	if err = writeFile(filename, reader, metadata.Mode.Perm()); err != nil {
+		return err
+	}
+
+	if err = metadata.Apply(filename, !skipOwnership); err != nil {
+		if os.IsPermission(err) && !skipOwnership {
+			return fmt.Errorf("Could not restore the owner %s:%s (%d:%d) of %s: %v. Use --skip-ownership when not restoring as root",
+				metadata.User, metadata.Group, metadata.UID, metadata.GID, filename, err)
+		}
+		return err
+	}
+
+	return nil
 }
 
-func restoreFile(filename string, manager backups.Manager) error {
-	reader, err := manager.Restore(filename)
+// writeFile streams the contents of `reader` into a temporary file next to
+// `filename` and renames it over `filename` once it is complete and synced,
+// so that a failed restore never leaves a partially written file. The file
+// gets permissions `perm`, or those of the file it replaces if `perm` is
+// zero, or 0644 if there is none.
+func writeFile(filename string, reader io.Reader, perm os.FileMode) error {
+	if perm == 0 {
+		perm = 0644
+		if info, err := os.Stat(filename); err == nil {
+			perm = info.Mode().Perm()
+		}
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".systools-")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(file.Name())
+
+	_, err = io.Copy(file, reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(file.Name(), perm)
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
 
-	bytes, err := ioutil.ReadAll(reader)
+// restoreDirectory restores version `version` of `dirname`, or the current
+// version if `version` is empty. If the version is an incremental backup,
+// each version of its chain is extracted in turn, starting from the last
+// full backup.
+func restoreDirectory(dirname string, version string, manager backups.Manager) error {
+	var chain []backups.Version
+	var err error
+	if version == "" {
+		chain, err = manager.Chain(dirname)
+	} else {
+		chain, err = manager.VersionChain(dirname, version)
+	}
 	if err != nil {
 		return err
 	}
 
-	// TODO: Add metadata to lock to restore proper permissions.
-	return ioutil.WriteFile(filename, bytes, os.FileMode(0666))
+	// Each version is verified in full before it is extracted, since
+	// extracting stops at the end of the tarball without reading the rest
+	// of the version. Versions are spooled one at a time, so that only the
+	// largest of them needs room in the temporary directory.
+	for _, link := range chain {
+		if err = extractVersion(link, path.Dir(dirname), manager); err != nil {
+			return err
+		}
+
+		if link.Parent == "" {
+			continue
+		}
+
+		manifest, err := readManifest(link, manager)
+		if err != nil {
+			return err
+		}
+
+		if err = manifest.ApplyDeletions(path.Dir(dirname)); err != nil {
+			return fmt.Errorf("Could not delete files removed in version %s: %v", backups.ShortVersion(link.ID), err)
+		}
+	}
+
+	return nil
 }
 
-func restoreDirectory(dirname string, manager backups.Manager) error {
-	reader, err := manager.Restore(dirname)
+// extractVersion verifies the tarball of `version` and extracts it into
+// `targetDir`.
+func extractVersion(version backups.Version, targetDir string, manager backups.Manager) error {
+	reader, cleanup, err := manager.ReadVerifiedVersion(version)
+	defer cleanup()
 	if err != nil {
 		return err
 	}
 
-	if err = filesystem.ExtractTarball(reader, path.Dir(dirname)); err != nil {
+	if err = filesystem.ExtractTarball(reader, targetDir); err != nil {
 		return fmt.Errorf("Could not restore from tarball: %v", err)
 	}
+
 	return nil
 }
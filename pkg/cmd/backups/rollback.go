@@ -0,0 +1,53 @@
+package backups
+
+import (
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachRollbackCommand(rootCmd *cobra.Command) {
+	var flags = &managerFlags{}
+	var rollbackCmd = &cobra.Command{
+		Use:   "rollback <file or directory> [version]",
+		Short: "Point a backup back to an older version, or the previous version if none is given",
+		Long: "Point a backup back to an older version, or the previous version if none is given. " +
+			"Every following restore, from any host, restores that version until the next backup.",
+		Args: cobra.RangeArgs(1, 2),
+		Run: func(cmd *cobra.Command, args []string) {
+			var id string
+			if len(args) > 1 {
+				id = args[1]
+			}
+
+			if err := runRollbackCommand(args[0], id, flags); err != nil {
+				logrus.Fatalf("Failed to roll back %s: %v", args[0], err)
+			}
+		},
+	}
+
+	rollbackCmd.Flags().BoolVar(&flags.SkipVerify, "skip-verify", false, "Roll back even if the backup's signature cannot be verified. Dangerous!")
+
+	rootCmd.AddCommand(rollbackCmd)
+}
+
+func runRollbackCommand(path string, id string, flags *managerFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(*flags)
+	if err != nil {
+		return err
+	}
+
+	version, err := manager.Rollback(name, id)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Rolled back %s to version %s", name, backups.ShortVersion(version.ID))
+
+	return nil
+}
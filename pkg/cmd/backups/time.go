@@ -0,0 +1,87 @@
+package backups
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// absoluteTimeFormats are the formats accepted for absolute times, which are
+// interpreted in the local time zone unless they include one.
+var absoluteTimeFormats = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// relativeTimePattern matches relative times such as "2 days ago".
+var relativeTimePattern = regexp.MustCompile(`^(\d+)\s*(minute|hour|day|week|month|year)s?\s+ago$`)
+
+// parseTime parses an absolute time such as "2026-10-01 03:00" or a relative
+// time such as "2 days ago", relative to `now`.
+func parseTime(value string, now time.Time) (time.Time, error) {
+	value = strings.TrimSpace(value)
+
+	if match := relativeTimePattern.FindStringSubmatch(strings.ToLower(value)); match != nil {
+		amount, err := strconv.Atoi(match[1])
+		if err != nil {
+			return time.Time{}, err
+		}
+
+		switch match[2] {
+		case "minute":
+			return now.Add(-time.Duration(amount) * time.Minute), nil
+		case "hour":
+			return now.Add(-time.Duration(amount) * time.Hour), nil
+		case "day":
+			return now.AddDate(0, 0, -amount), nil
+		case "week":
+			return now.AddDate(0, 0, -7*amount), nil
+		case "month":
+			return now.AddDate(0, -amount, 0), nil
+		case "year":
+			return now.AddDate(-amount, 0, 0), nil
+		}
+	}
+
+	for _, format := range absoluteTimeFormats {
+		if t, err := time.ParseInLocation(format, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("Unable to parse time %q. Use a format like \"2006-01-02 15:04\" or \"2 days ago\"", value)
+}
+
+// durationPattern matches durations in days or weeks, such as "30d" or "2w",
+// which time.ParseDuration doesn't accept.
+var durationPattern = regexp.MustCompile(`^(\d+)([dw])$`)
+
+// parseDuration parses a duration such as "36h", "30d" or "2w".
+func parseDuration(value string) (time.Duration, error) {
+	if match := durationPattern.FindStringSubmatch(strings.TrimSpace(value)); match != nil {
+		amount, err := strconv.Atoi(match[1])
+		if err != nil {
+			return 0, err
+		}
+
+		days := amount
+		if match[2] == "w" {
+			days *= 7
+		}
+
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to parse duration %q. Use a format like \"36h\", \"30d\" or \"2w\"", value)
+	}
+
+	return duration, nil
+}
@@ -0,0 +1,58 @@
+package backups
+
+import (
+	"time"
+
+	"github.com/samrap/systools/pkg/backups"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+func attachUnlockCommand(rootCmd *cobra.Command) {
+	var flags = &managerFlags{}
+	var unlockCmd = &cobra.Command{
+		Use:   "unlock <file or directory>",
+		Short: "Remove the lease of a backup that stopped without releasing it",
+		Long: "Remove the lease of a backup that stopped without releasing it, so that the next backup can run " +
+			"before the lease expires. Only use this if the backup holding the lease is known to have stopped.",
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := runUnlockCommand(args[0], flags); err != nil {
+				logrus.Fatalf("Failed to unlock %s: %v", args[0], err)
+			}
+		},
+	}
+
+	rootCmd.AddCommand(unlockCmd)
+}
+
+func runUnlockCommand(path string, flags *managerFlags) error {
+	name, err := backups.CanonicalPath(path)
+	if err != nil {
+		return err
+	}
+
+	manager, err := newManager(*flags)
+	if err != nil {
+		return err
+	}
+
+	lease, err := manager.Unlock(name)
+	if err != nil {
+		return err
+	}
+
+	if lease == nil {
+		logrus.Infof("No backup of %s holds a lease", name)
+		return nil
+	}
+
+	state := "expired"
+	if !lease.Expired(time.Now()) {
+		state = "unexpired"
+	}
+
+	logrus.Warnf("Removed the %s lease of %s held by %s (pid %d) since %s", state, name, lease.Host, lease.PID, lease.AcquiredAt.Local().Format(time.RFC3339))
+
+	return nil
+}
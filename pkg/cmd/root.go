@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/samrap/systools/pkg/cmd/backups"
+	"github.com/samrap/systools/pkg/version"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -10,8 +11,9 @@ import (
 func Execute() {
 	// Create the root command.
 	var rootCmd = &cobra.Command{
-		Use:   "systools",
-		Short: "Systools are system tools for common server tasks",
+		Use:     "systools",
+		Short:   "Systools are system tools for common server tasks",
+		Version: version.Version,
 	}
 
 	// Attach all sub commands.
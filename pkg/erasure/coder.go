@@ -0,0 +1,156 @@
+// Package erasure implements Reed-Solomon erasure coding, which splits data
+// into data shards and computes parity shards such that the data can be
+// reconstructed from any combination of shards as numerous as the data
+// shards.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTooFewShards is returned when too many shards are missing to
+// reconstruct the data.
+var ErrTooFewShards = errors.New("erasure: too few shards to reconstruct the data")
+
+// Coder encodes and reconstructs shards for a fixed number of data and
+// parity shards.
+type Coder struct {
+	dataShards   int
+	parityShards int
+
+	// encoding is a (data+parity)xdata matrix whose top rows form the
+	// identity matrix, so that data shards are stored as is, and whose
+	// bottom rows compute the parity shards.
+	encoding matrix
+}
+
+// NewCoder returns a Coder for `dataShards` data shards and `parityShards`
+// parity shards. There may be at most 256 shards in total.
+func NewCoder(dataShards, parityShards int) (*Coder, error) {
+	if dataShards < 1 || parityShards < 0 {
+		return nil, fmt.Errorf("erasure: invalid number of shards %d+%d", dataShards, parityShards)
+	}
+	if dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("erasure: at most 256 shards are supported, got %d", dataShards+parityShards)
+	}
+
+	// Multiplying a Vandermonde matrix by the inverse of its top square
+	// keeps any `dataShards` rows linearly independent while making the
+	// top square the identity matrix.
+	v := vandermonde(dataShards+parityShards, dataShards)
+	top, err := v.subMatrix(rowRange(0, dataShards)).invert()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Coder{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		encoding:     v.multiply(top),
+	}, nil
+}
+
+// DataShards returns the number of data shards.
+func (c *Coder) DataShards() int {
+	return c.dataShards
+}
+
+// ParityShards returns the number of parity shards.
+func (c *Coder) ParityShards() int {
+	return c.parityShards
+}
+
+// Encode computes the parity shards from the data shards. `shards` must hold
+// every shard, data shards first, and all shards must be the same size.
+func (c *Coder) Encode(shards [][]byte) error {
+	if err := c.checkShards(shards, false); err != nil {
+		return err
+	}
+
+	for p := 0; p < c.parityShards; p++ {
+		parity := shards[c.dataShards+p]
+		for i := range parity {
+			parity[i] = 0
+		}
+		for d := 0; d < c.dataShards; d++ {
+			galMultiplyAdd(c.encoding[c.dataShards+p][d], shards[d], parity)
+		}
+	}
+
+	return nil
+}
+
+// ReconstructData fills in the missing data shards of `shards`, where missing
+// shards are nil. At least as many shards as there are data shards must be
+// present. Missing parity shards are left nil.
+func (c *Coder) ReconstructData(shards [][]byte) error {
+	if err := c.checkShards(shards, true); err != nil {
+		return err
+	}
+
+	var present []int
+	missing := false
+	for i, shard := range shards {
+		if shard != nil && len(present) < c.dataShards {
+			present = append(present, i)
+		} else if shard == nil && i < c.dataShards {
+			missing = true
+		}
+	}
+	if !missing {
+		return nil
+	}
+	if len(present) < c.dataShards {
+		return ErrTooFewShards
+	}
+
+	decoding, err := c.encoding.subMatrix(present).invert()
+	if err != nil {
+		return err
+	}
+
+	size := len(shards[present[0]])
+	for d := 0; d < c.dataShards; d++ {
+		if shards[d] != nil {
+			continue
+		}
+
+		data := make([]byte, size)
+		for i, p := range present {
+			galMultiplyAdd(decoding[d][i], shards[p], data)
+		}
+		shards[d] = data
+	}
+
+	return nil
+}
+
+func (c *Coder) checkShards(shards [][]byte, allowMissing bool) error {
+	if len(shards) != c.dataShards+c.parityShards {
+		return fmt.Errorf("erasure: expected %d shards, got %d", c.dataShards+c.parityShards, len(shards))
+	}
+
+	size := -1
+	for _, shard := range shards {
+		if shard == nil && allowMissing {
+			continue
+		}
+		if size == -1 {
+			size = len(shard)
+		} else if len(shard) != size {
+			return errors.New("erasure: shards must all be the same size")
+		}
+	}
+
+	return nil
+}
+
+func rowRange(start, end int) []int {
+	rows := make([]int, 0, end-start)
+	for r := start; r < end; r++ {
+		rows = append(rows, r)
+	}
+
+	return rows
+}
@@ -0,0 +1,54 @@
+package erasure
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newShards(t *testing.T, coder *Coder, size int) [][]byte {
+	random := rand.New(rand.NewSource(1))
+	shards := make([][]byte, coder.DataShards()+coder.ParityShards())
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < coder.DataShards() {
+			random.Read(shards[i])
+		}
+	}
+
+	assert.NoError(t, coder.Encode(shards))
+
+	return shards
+}
+
+func Test_ItReconstructsFromAnyDataShardsWorthOfShards(t *testing.T) {
+	coder, err := NewCoder(4, 2)
+	assert.NoError(t, err)
+
+	shards := newShards(t, coder, 1000)
+
+	// Try every combination of two missing shards.
+	for a := 0; a < len(shards); a++ {
+		for b := a + 1; b < len(shards); b++ {
+			damaged := append([][]byte{}, shards...)
+			damaged[a] = nil
+			damaged[b] = nil
+
+			assert.NoError(t, coder.ReconstructData(damaged))
+			for d := 0; d < coder.DataShards(); d++ {
+				assert.Equal(t, shards[d], damaged[d], "shard %d with %d and %d missing", d, a, b)
+			}
+		}
+	}
+}
+
+func Test_ItFailsWithTooFewShards(t *testing.T) {
+	coder, err := NewCoder(4, 2)
+	assert.NoError(t, err)
+
+	shards := newShards(t, coder, 10)
+	shards[0], shards[1], shards[5] = nil, nil, nil
+
+	assert.Equal(t, ErrTooFewShards, coder.ReconstructData(shards))
+}
@@ -0,0 +1,68 @@
+package erasure
+
+// Arithmetic in GF(2^8) using the primitive polynomial x^8+x^4+x^3+x^2+1.
+// Addition and subtraction are both XOR, while multiplication and division
+// are done with log and exponent tables.
+
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func galMultiply(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func galDivide(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	if b == 0 {
+		panic("erasure: division by zero")
+	}
+
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+func galExp(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// galMultiplyAdd adds `c` times each byte of `in` to the bytes of `out`.
+func galMultiplyAdd(c byte, in []byte, out []byte) {
+	if c == 0 {
+		return
+	}
+
+	logC := int(logTable[c])
+	for i, b := range in {
+		if b != 0 {
+			out[i] ^= expTable[logC+int(logTable[b])]
+		}
+	}
+}
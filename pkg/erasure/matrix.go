@@ -0,0 +1,114 @@
+package erasure
+
+import "errors"
+
+// errSingular is returned when inverting a matrix which has no inverse.
+var errSingular = errors.New("erasure: matrix is singular")
+
+// matrix is a row-major matrix of GF(2^8) elements.
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+
+	return m
+}
+
+func identityMatrix(size int) matrix {
+	m := newMatrix(size, size)
+	for i := range m {
+		m[i][i] = 1
+	}
+
+	return m
+}
+
+// vandermonde returns a matrix where row r is (r^0, r^1, ..., r^(cols-1)).
+// Any `cols` of its rows are linearly independent.
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = galExp(byte(r), c)
+		}
+	}
+
+	return m
+}
+
+func (m matrix) multiply(other matrix) matrix {
+	result := newMatrix(len(m), len(other[0]))
+	for r := range result {
+		for c := range result[r] {
+			var value byte
+			for i := range other {
+				value ^= galMultiply(m[r][i], other[i][c])
+			}
+			result[r][c] = value
+		}
+	}
+
+	return result
+}
+
+// subMatrix returns the given rows of the matrix.
+func (m matrix) subMatrix(rows []int) matrix {
+	result := make(matrix, len(rows))
+	for i, r := range rows {
+		result[i] = append([]byte{}, m[r]...)
+	}
+
+	return result
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan
+// elimination.
+func (m matrix) invert() (matrix, error) {
+	size := len(m)
+	work := newMatrix(size, 2*size)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][size+r] = 1
+	}
+
+	for c := 0; c < size; c++ {
+		// Find a row with a non-zero value in this column to pivot on.
+		pivot := -1
+		for r := c; r < size; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot == -1 {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		// Scale the pivot row so the pivot is 1.
+		scale := galDivide(1, work[c][c])
+		for i := range work[c] {
+			work[c][i] = galMultiply(work[c][i], scale)
+		}
+
+		// Eliminate the column from every other row.
+		for r := 0; r < size; r++ {
+			if r != c && work[r][c] != 0 {
+				factor := work[r][c]
+				for i := range work[r] {
+					work[r][i] ^= galMultiply(factor, work[c][i])
+				}
+			}
+		}
+	}
+
+	result := make(matrix, size)
+	for r := range work {
+		result[r] = work[r][size:]
+	}
+
+	return result, nil
+}
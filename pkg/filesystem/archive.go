@@ -6,34 +6,25 @@ import (
 	"io"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 // CreateTarball takes a source directory and walks the directory recursively,
 // constructing a tarball stored in `targetDir`. It returns `tarpath`, the
 // full path to the created tarfile and `err` if the archival fails.
 func CreateTarball(source, targetDir string) (tarPath string, err error) {
-	// baseName is the base directory of `source`, which must be included in the
-	// file name of the headers written to the tarball. For example, if the
-	// source is directory `/foo/bar`, and `bar` contains several files
-	// which will be put in the archive, their header's name field
-	// must include their base directory, `bar`, such that the
-	// header contains the entire path relative to `bar`.
-	//
-	// If `source` is not a directory, then `baseName` should be an empty string.
-	var baseName string
+	return CreatePartialTarball(source, targetDir, nil)
+}
 
+// CreatePartialTarball is like CreateTarball, but only includes the files
+// whose names are in `include`, along with every directory so that the tree
+// can be recreated. If `include` is nil, every file is included.
+func CreatePartialTarball(source, targetDir string, include map[string]bool) (tarPath string, err error) {
 	// Get file info for the source file.
 	sourceInfo, err := os.Stat(source)
 	if err != nil {
 		return tarPath, err
 	}
 
-	// We only need to specify the base directory if `source` is a directory.
-	if sourceInfo.IsDir() {
-		baseName = filepath.Base(source)
-	}
-
 	// Create a tar file to write to.
 	tarPath = filepath.Join(targetDir, fmt.Sprintf("%s.tar", sourceInfo.Name()))
 	tarfile, err := os.Create(tarPath)
@@ -42,16 +33,28 @@ func CreateTarball(source, targetDir string) (tarPath string, err error) {
 	}
 	defer tarfile.Close()
 
+	return tarPath, WritePartialTarball(source, tarfile, include)
+}
+
+// WriteTarball is like CreateTarball, but streams the tarball to `writer`
+// instead of storing it in a file.
+func WriteTarball(source string, writer io.Writer) error {
+	return WritePartialTarball(source, writer, nil)
+}
+
+// WritePartialTarball is like CreatePartialTarball, but streams the tarball
+// to `writer` instead of storing it in a file.
+func WritePartialTarball(source string, writer io.Writer, include map[string]bool) error {
 	// Create a tarball to write to.
-	tarball := tar.NewWriter(tarfile)
-	defer tarball.Close()
+	tarball := tar.NewWriter(writer)
 
-	return tarPath, filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+	err := walkTree(source, func(path string, name string, info os.FileInfo) error {
 		// link is the destination that path points to if it is a symbolic link.
 		var link string
+		var err error
 
-		if err != nil {
-			return err
+		if include != nil && !info.IsDir() && !include[name] {
+			return nil
 		}
 
 		// If we are dealing with a symbolic link, then we need to get the path
@@ -67,11 +70,7 @@ func CreateTarball(source, targetDir string) (tarPath string, err error) {
 		if err != nil {
 			return err
 		}
-
-		// We need to include the base name of source if it is a directory.
-		if baseName != "" {
-			header.Name = filepath.Join(baseName, strings.TrimPrefix(path, source))
-		}
+		header.Name = name
 
 		// Write the header.
 		if err := tarball.WriteHeader(header); err != nil {
@@ -92,6 +91,13 @@ func CreateTarball(source, targetDir string) (tarPath string, err error) {
 		_, err = io.Copy(tarball, file)
 		return err
 	})
+	if err != nil {
+		return err
+	}
+
+	// Closing the tarball writes its footer, so it must succeed for the
+	// tarball to be valid.
+	return tarball.Close()
 }
 
 // ExtractTarball takes a reader containing tarball bytes and attempts to extract
@@ -119,7 +125,11 @@ func ExtractTarball(reader io.Reader, targetDir string) error {
 			continue
 		} else if info.Mode()&os.ModeSymlink != 0 {
 			// If the file is a symlink, we will simply create the link using
-			// the link name stored in the header.
+			// the link name stored in the header, replacing any file left
+			// from a previously extracted tarball.
+			if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
 			if err = os.Symlink(header.Linkname, path); err != nil {
 				return err
 			}
@@ -127,7 +137,13 @@ func ExtractTarball(reader io.Reader, targetDir string) error {
 		}
 
 		// Finally, if we are dealing with a regular file we will copy the
-		// contents from the tar reader into a newly created file.
+		// contents from the tar reader into a newly created file. A symlink
+		// left in its place must be removed so that we don't write through it.
+		if existing, err := os.Lstat(path); err == nil && existing.Mode()&os.ModeSymlink != 0 {
+			if err = os.Remove(path); err != nil {
+				return err
+			}
+		}
 		file, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
 		if err != nil {
 			return err
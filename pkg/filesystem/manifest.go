@@ -0,0 +1,190 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ManifestFormat is the format of the manifests built by this version of the
+// package. Format 0 manifests are identical to format 1.
+const ManifestFormat = 1
+
+// Manifest describes every file in a directory tree at the time of a backup.
+// It is used to determine which files changed between incremental backups.
+type Manifest struct {
+	// Format is the format the manifest was built in, see ManifestFormat.
+	Format int `json:"format,omitempty"`
+
+	// Files maps the name of each file, as it is stored in a tarball of the
+	// tree, to its attributes.
+	Files map[string]ManifestEntry `json:"files"`
+
+	// Deleted lists the files that existed in the previous manifest of an
+	// incremental backup but no longer exist.
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// ManifestEntry holds the attributes of a single file used to detect changes.
+type ManifestEntry struct {
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mtime"`
+	Mode    os.FileMode `json:"mode"`
+
+	// Hash is the hex encoded SHA-256 sum of a regular file's contents.
+	Hash string `json:"hash,omitempty"`
+
+	// Link is the destination of a symbolic link.
+	Link string `json:"link,omitempty"`
+}
+
+// NewManifestFromBytes unmarshals a manifest's JSON bytes into a Manifest.
+// Manifests of a later format than ManifestFormat are refused.
+func NewManifestFromBytes(bytes []byte) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(bytes, &m); err != nil {
+		return m, err
+	}
+
+	if m.Format > ManifestFormat {
+		return m, fmt.Errorf("Manifest has format %d, which is newer than this version of systools supports", m.Format)
+	}
+
+	return m, nil
+}
+
+// BuildManifest walks `source` and records every file in a Manifest. If a
+// `previous` manifest is given, the hashes of files whose size, modification
+// time and mode are unchanged are reused from it instead of being computed.
+func BuildManifest(source string, previous *Manifest) (Manifest, error) {
+	manifest := Manifest{Format: ManifestFormat, Files: make(map[string]ManifestEntry)}
+
+	err := walkTree(source, func(path string, name string, info os.FileInfo) error {
+		entry := ManifestEntry{
+			Size:    info.Size(),
+			ModTime: info.ModTime().UTC(),
+			Mode:    info.Mode(),
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entry.Link = link
+		case info.Mode().IsRegular():
+			if previous != nil {
+				if old, ok := previous.Files[name]; ok && old.Size == entry.Size && old.ModTime.Equal(entry.ModTime) && old.Mode == entry.Mode {
+					entry.Hash = old.Hash
+				}
+			}
+			if entry.Hash == "" {
+				hash, err := hashFile(path)
+				if err != nil {
+					return err
+				}
+				entry.Hash = hash
+			}
+		}
+
+		manifest.Files[name] = entry
+
+		return nil
+	})
+
+	return manifest, err
+}
+
+// Changes returns the names of files that were added or changed since the
+// `previous` manifest and the names of files that were deleted since then.
+func (m Manifest) Changes(previous Manifest) (changed []string, deleted []string) {
+	for name, entry := range m.Files {
+		if old, ok := previous.Files[name]; !ok || old != entry {
+			changed = append(changed, name)
+		}
+	}
+
+	for name := range previous.Files {
+		if _, ok := m.Files[name]; !ok {
+			deleted = append(deleted, name)
+		}
+	}
+
+	sort.Strings(changed)
+	sort.Strings(deleted)
+
+	return changed, deleted
+}
+
+// ApplyDeletions removes each file in the manifest's deletion list from the
+// tree extracted into `targetDir`.
+func (m Manifest) ApplyDeletions(targetDir string) error {
+	for _, name := range m.Deleted {
+		if err := os.RemoveAll(filepath.Join(targetDir, name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkTree walks `source` recursively, calling `fn` with the path of each file
+// along with the name the file has inside a tarball of `source`.
+func walkTree(source string, fn func(path string, name string, info os.FileInfo) error) error {
+	// baseName is the base directory of `source`, which must be included in the
+	// file name of the headers written to the tarball. For example, if the
+	// source is directory `/foo/bar`, and `bar` contains several files
+	// which will be put in the archive, their header's name field
+	// must include their base directory, `bar`, such that the
+	// header contains the entire path relative to `bar`.
+	//
+	// If `source` is not a directory, then `baseName` should be an empty string.
+	var baseName string
+
+	// Get file info for the source file.
+	sourceInfo, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+
+	// We only need to specify the base directory if `source` is a directory.
+	if sourceInfo.IsDir() {
+		baseName = filepath.Base(source)
+	}
+
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		name := info.Name()
+		if baseName != "" {
+			name = filepath.Join(baseName, strings.TrimPrefix(path, source))
+		}
+
+		return fn(path, name, info)
+	})
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,5 @@
+package version
+
+// Version is the version of systools. It is set when building a release, with
+// -ldflags "-X github.com/samrap/systools/pkg/version.Version=vN.N.N".
+var Version = "dev"